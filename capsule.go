@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// Capsule types (RFC 9297 5.4)
+const (
+	CapsuleTypeDatagram uint64 = 0x00
+)
+
+// defaultMaxCapsuleLength is the initial CapsuleStream.MaxLength. It leaves
+// room for a context ID and the largest UDP payload.
+const defaultMaxCapsuleLength = 65536
+
+// maxVarint is the largest QUIC variable-length integer.
+const maxVarint = 1<<62 - 1
+
+var (
+	errCapsuleTruncated = errors.New("truncated capsule")
+	errCapsuleTooLarge  = errors.New("capsule too large")
+)
+
+// appendVarint appends v, which must not exceed maxVarint, as a QUIC
+// variable-length integer (RFC 9000 16).
+func appendVarint(dst []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(dst, byte(v))
+	case v < 1<<14:
+		return append(dst, 0x40|byte(v>>8), byte(v))
+	case v < 1<<30:
+		return append(dst, 0x80|byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(dst, 0xc0|byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+// parseVarint returns the variable-length integer at the start of input and
+// its length.
+func parseVarint(input []byte) (uint64, int, error) {
+	if len(input) == 0 {
+		return 0, 0, errCapsuleTruncated
+	}
+	n := 1 << (input[0] >> 6)
+	if len(input) < n {
+		return 0, 0, errCapsuleTruncated
+	}
+
+	v := uint64(input[0] & 0x3f)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(input[i])
+	}
+	return v, n, nil
+}
+
+// Capsule is a Capsule Protocol message (RFC 9297 3.2).
+type Capsule struct {
+	Type  uint64
+	Value []byte
+}
+
+func appendCapsule(dst []byte, c Capsule) []byte {
+	dst = appendVarint(dst, c.Type)
+	dst = appendVarint(dst, uint64(len(c.Value)))
+	return append(dst, c.Value...)
+}
+
+// parseCapsule parses the capsule at the start of input and returns its
+// length on the wire. Value aliases input.
+func parseCapsule(input []byte, maxLength int) (Capsule, int, error) {
+	typ, n, err := parseVarint(input)
+	if err != nil {
+		return Capsule{}, 0, err
+	}
+	length, m, err := parseVarint(input[n:])
+	if err != nil {
+		return Capsule{}, 0, err
+	}
+	n += m
+
+	if length > uint64(maxLength) {
+		return Capsule{}, 0, errCapsuleTooLarge
+	}
+	if uint64(len(input)-n) < length {
+		return Capsule{}, 0, errCapsuleTruncated
+	}
+	return Capsule{typ, input[n : n+int(length)]}, n + int(length), nil
+}
+
+// CapsuleStream exchanges capsules over the DATA frames of a tunnel opened
+// with the Capsule Protocol, and HTTP Datagrams in DATAGRAM capsules.
+type CapsuleStream struct {
+	// MaxLength limits the length of received capsule values. A larger
+	// capsule aborts the stream.
+	MaxLength int
+
+	tunnel *Tunnel
+	buf    []byte
+	chunk  []byte
+}
+
+func NewCapsuleStream(t *Tunnel) *CapsuleStream {
+	return &CapsuleStream{
+		MaxLength: defaultMaxCapsuleLength,
+		tunnel:    t,
+		chunk:     make([]byte, 16384),
+	}
+}
+
+// ReadCapsule returns the next capsule. A partial capsule stays buffered
+// if the tunnel's read deadline passes, so reading can continue later.
+func (s *CapsuleStream) ReadCapsule() (Capsule, error) {
+	for {
+		c, n, err := parseCapsule(s.buf, s.MaxLength)
+		if err == nil {
+			c.Value = append([]byte(nil), c.Value...)
+			s.buf = s.buf[n:]
+			return c, nil
+		}
+		if err != errCapsuleTruncated {
+			s.abort()
+			return Capsule{}, err
+		}
+
+		m, err := s.tunnel.Read(s.chunk)
+		s.buf = append(s.buf, s.chunk[:m]...)
+		if err == io.EOF && len(s.buf) > 0 {
+			s.abort()
+			return Capsule{}, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return Capsule{}, err
+		}
+	}
+}
+
+// abort resets the stream after a malformed capsule.
+func (s *CapsuleStream) abort() {
+	sid := s.tunnel.stream.StreamID
+	s.tunnel.abort(StreamError{sid, ErrorCodeProtocolError}, ErrorCodeProtocolError)
+}
+
+func (s *CapsuleStream) WriteCapsule(c Capsule) error {
+	_, err := s.tunnel.Write(appendCapsule(nil, c))
+	return err
+}
+
+// ReadDatagram returns the payload of the next DATAGRAM capsule. Capsules
+// of other types are skipped.
+func (s *CapsuleStream) ReadDatagram() ([]byte, error) {
+	for {
+		c, err := s.ReadCapsule()
+		if err != nil {
+			return nil, err
+		}
+		if c.Type == CapsuleTypeDatagram {
+			return c.Value, nil
+		}
+	}
+}
+
+func (s *CapsuleStream) WriteDatagram(payload []byte) error {
+	return s.WriteCapsule(Capsule{CapsuleTypeDatagram, payload})
+}
+
+func (s *CapsuleStream) Close() error {
+	return s.tunnel.Close()
+}
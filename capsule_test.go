@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// RFC 9000 A.1
+func TestVarint(t *testing.T) {
+	testcases := []struct {
+		wire    string
+		value   uint64
+		minimal bool
+	}{
+		{"c2197c5eff14e88c", 151288809941952652, true},
+		{"9d7f3e7d", 494878333, true},
+		{"7bbd", 15293, true},
+		{"25", 37, true},
+		{"4025", 37, false},
+		{"3f", 63, true},
+		{"4040", 64, true},
+		{"ffffffffffffffff", maxVarint, true},
+	}
+
+	for _, tc := range testcases {
+		wire, _ := hex.DecodeString(tc.wire)
+		value, n, err := parseVarint(append(wire, 0xff))
+		assert.Nil(t, err, tc.wire)
+		assert.Equal(t, tc.value, value, tc.wire)
+		assert.Equal(t, len(wire), n, tc.wire)
+
+		_, _, err = parseVarint(wire[:len(wire)-1])
+		assert.Equal(t, errCapsuleTruncated, err, tc.wire)
+
+		if tc.minimal {
+			assert.Equal(t, tc.wire, hex.EncodeToString(appendVarint(nil, tc.value)))
+		}
+	}
+}
+
+func TestParseCapsule(t *testing.T) {
+	wire := appendCapsule(nil, Capsule{CapsuleTypeDatagram, []byte("hello")})
+	assert.Equal(t, "000568656c6c6f", hex.EncodeToString(wire))
+
+	wire = appendCapsule(wire, Capsule{0x17, make([]byte, 300)})
+	c, n, err := parseCapsule(wire, 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, Capsule{CapsuleTypeDatagram, []byte("hello")}, c)
+	assert.Equal(t, 7, n)
+
+	c, n, err = parseCapsule(wire[7:], 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0x17), c.Type)
+	assert.Equal(t, 300, len(c.Value))
+	assert.Equal(t, len(wire)-7, n)
+
+	for i := 0; i < 7; i++ {
+		_, _, err = parseCapsule(wire[:i], 1000)
+		assert.Equal(t, errCapsuleTruncated, err, "%d", i)
+	}
+	_, _, err = parseCapsule(wire[7:10], 299)
+	assert.Equal(t, errCapsuleTooLarge, err)
+}
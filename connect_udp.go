@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxUDPPayload is the largest payload of a UDP datagram.
+const maxUDPPayload = 65527
+
+// UDPTunnel is a CONNECT-UDP tunnel (RFC 9298) used as a net.PacketConn.
+// Its datagrams are exchanged with a single target, as HTTP Datagrams with
+// context ID 0.
+type UDPTunnel struct {
+	capsules *CapsuleStream
+	target   net.Addr
+}
+
+// DialUDP asks the proxy on this connection to forward UDP to target, a
+// host and port. template is the proxy's URI template, such as
+// "https://proxy.example/.well-known/masque/udp/{target_host}/{target_port}/".
+func (c *Connection) DialUDP(template string, target string) (*UDPTunnel, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+
+	// Colons in IPv6 addresses have to be percent-encoded too.
+	rawurl := strings.NewReplacer(
+		"{target_host}", strings.ReplaceAll(url.PathEscape(host), ":", "%3A"),
+		"{target_port}", url.PathEscape(port),
+	).Replace(template)
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnel, err := c.ExtendedConnect("connect-udp", u, []HeaderField{{"capsule-protocol", "?1"}})
+	if err != nil {
+		return nil, err
+	}
+	return &UDPTunnel{
+		capsules: NewCapsuleStream(tunnel),
+		target:   tunnelAddr{"udp", target},
+	}, nil
+}
+
+// ReadFrom reads the next datagram from the target. Like a UDP socket, it
+// discards the part of the datagram that does not fit in p.
+func (u *UDPTunnel) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		payload, err := u.capsules.ReadDatagram()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		contextID, n, err := parseVarint(payload)
+		if err != nil {
+			u.capsules.abort()
+			return 0, nil, err
+		}
+		// Other context IDs belong to extensions that were not
+		// negotiated.
+		if contextID != 0 {
+			continue
+		}
+		return copy(p, payload[n:]), u.target, nil
+	}
+}
+
+// WriteTo sends p to the target, which addr must be if it is not nil.
+func (u *UDPTunnel) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if addr != nil && addr.String() != u.target.String() {
+		return 0, fmt.Errorf("tunnel only reaches %s, not %s", u.target, addr)
+	}
+	if len(p) > maxUDPPayload {
+		return 0, fmt.Errorf("datagram of %d octets is too large", len(p))
+	}
+
+	payload := append(appendVarint(nil, 0), p...)
+	if err := u.capsules.WriteDatagram(payload); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (u *UDPTunnel) Close() error {
+	return u.capsules.Close()
+}
+
+func (u *UDPTunnel) LocalAddr() net.Addr {
+	return u.capsules.tunnel.LocalAddr()
+}
+
+// RemoteAddr returns the target address.
+func (u *UDPTunnel) RemoteAddr() net.Addr {
+	return u.target
+}
+
+func (u *UDPTunnel) SetDeadline(deadline time.Time) error {
+	return u.capsules.tunnel.SetDeadline(deadline)
+}
+
+func (u *UDPTunnel) SetReadDeadline(deadline time.Time) error {
+	return u.capsules.tunnel.SetReadDeadline(deadline)
+}
+
+func (u *UDPTunnel) SetWriteDeadline(deadline time.Time) error {
+	return u.capsules.tunnel.SetWriteDeadline(deadline)
+}
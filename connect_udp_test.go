@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	_ net.Conn       = (*Tunnel)(nil)
+	_ net.PacketConn = (*UDPTunnel)(nil)
+)
+
+// startUDPEcho starts a UDP server that sends every datagram back.
+func startUDPEcho(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc
+}
+
+// startMasqueStandIn serves a single CONNECT-UDP request on the test
+// server's end of the connection, forwarding datagrams to a real UDP
+// socket. Every datagram it returns is preceded by a capsule of an unknown
+// type and by a datagram with an unknown context ID, which the client has
+// to skip.
+func startMasqueStandIn(t *testing.T, srv *testServer) chan []HeaderField {
+	requests := make(chan []HeaderField, 1)
+	// The forwarding goroutines can outlive the test, so write errors
+	// are ignored.
+	write := func(frame Frame) {
+		srv.conn.Write(frame.Serialize())
+	}
+	go func() {
+		var hf *HeadersFrame
+		for frame := range srv.frames {
+			if f, ok := frame.(*HeadersFrame); ok {
+				hf = f
+				break
+			}
+		}
+		if hf == nil {
+			return
+		}
+		sid := hf.Header.StreamIdentifier
+		fields, err := srv.decoder.Decode(hf.Payload.HeaderBlockFragment)
+		if err != nil {
+			return
+		}
+		requests <- fields
+
+		var path string
+		for _, h := range fields {
+			if h.Name == ":path" {
+				path = h.Value
+			}
+		}
+		// /.well-known/masque/udp/{target_host}/{target_port}/
+		segments := strings.Split(path, "/")
+		host, _ := url.PathUnescape(segments[4])
+		conn, err := net.Dial("udp", net.JoinHostPort(host, segments[5]))
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		block, _ := EncodeHeaders(HeaderList{{":status", "200"}, {"capsule-protocol", "?1"}})
+		write(testHeadersFrame(sid, FlagsEndHeaders, block))
+
+		go func() {
+			buf := make([]byte, 65536)
+			for {
+				n, err := conn.Read(buf)
+				if err != nil {
+					return
+				}
+				var data []byte
+				data = appendCapsule(data, Capsule{0x17, []byte("grease")})
+				data = appendCapsule(data, Capsule{CapsuleTypeDatagram, append(appendVarint(nil, 2), "extension"...)})
+				data = appendCapsule(data, Capsule{CapsuleTypeDatagram, append(appendVarint(nil, 0), buf[:n]...)})
+				write(testDataFrame(sid, 0, data))
+			}
+		}()
+
+		var pending []byte
+		for frame := range srv.frames {
+			df, ok := frame.(*DataFrame)
+			if !ok || df.Header.StreamIdentifier != sid {
+				continue
+			}
+			pending = append(pending, df.Payload.Data...)
+			for {
+				c, n, err := parseCapsule(pending, defaultMaxCapsuleLength)
+				if err != nil {
+					break
+				}
+				pending = pending[n:]
+				if contextID, m, err := parseVarint(c.Value); err == nil && contextID == 0 {
+					conn.Write(c.Value[m:])
+				}
+			}
+			if df.Header.Flags.Has(FlagsEndStream) {
+				write(testDataFrame(sid, FlagsEndStream, nil))
+				return
+			}
+		}
+	}()
+	return requests
+}
+
+func TestDialUDP(t *testing.T) {
+	echo := startUDPEcho(t)
+	c, srv := newTestConnection(t, nil)
+	srv.writeFrame(testSettingsFrame(0, SettingsParameter{SettingsEnableConnectProtocol, 1}))
+	requests := startMasqueStandIn(t, srv)
+
+	target := echo.LocalAddr().String()
+	pc, err := c.DialUDP("http://proxy.example/.well-known/masque/udp/{target_host}/{target_port}/", target)
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, port, _ := net.SplitHostPort(target)
+	assert.Equal(t, []HeaderField{
+		{":method", "CONNECT"},
+		{":protocol", "connect-udp"},
+		{":scheme", "http"},
+		{":authority", "proxy.example"},
+		{":path", "/.well-known/masque/udp/127.0.0.1/" + port + "/"},
+		{"capsule-protocol", "?1"},
+	}, <-requests)
+
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2000)
+	for _, datagram := range [][]byte{[]byte("ping"), bytes.Repeat([]byte{0x5a}, 1200), {}} {
+		n, err := pc.WriteTo(datagram, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, len(datagram), n)
+
+		n, addr, err := pc.ReadFrom(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, datagram, buf[:n])
+		assert.Equal(t, target, addr.String())
+		assert.Equal(t, "udp", addr.Network())
+	}
+
+	_, err = pc.WriteTo([]byte("ping"), &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53})
+	assert.NotNil(t, err)
+
+	// Reading continues normally after a timeout.
+	pc.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, _, err = pc.ReadFrom(buf)
+	assert.Equal(t, os.ErrDeadlineExceeded, err)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	pc.WriteTo([]byte("late"), nil)
+	n, _, err := pc.ReadFrom(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "late", string(buf[:n]))
+
+	assert.Nil(t, pc.Close())
+}
+
+func TestDialUDPIPv6Template(t *testing.T) {
+	c, srv := newTestConnection(t, nil)
+	srv.writeFrame(testSettingsFrame(0, SettingsParameter{SettingsEnableConnectProtocol, 1}))
+
+	go c.DialUDP("http://proxy.example/masque?h={target_host}&p={target_port}", "[2001:db8::1]:443")
+	hf := srv.readFrame(FrameTypeHeaders).(*HeadersFrame)
+	fields, err := srv.decoder.Decode(hf.Payload.HeaderBlockFragment)
+	assert.Nil(t, err)
+	assert.Contains(t, fields, HeaderField{":path", "/masque?h=2001%3Adb8%3A%3A1&p=443"})
+}
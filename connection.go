@@ -3,71 +3,201 @@ package main
 import (
 	"bufio"
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
 	"math"
 	"net"
+	"net/url"
+	"strings"
+	"sync"
 )
 
 type Connection struct {
-	Streams       map[uint32]Stream
+	mu            sync.Mutex
+	Streams       map[uint32]*Stream
 	Conn          *net.Conn
 	Tls           *tls.Conn
 	Reader        *bufio.Reader
 	Writer        *bufio.Writer
+	writeMu       sync.Mutex
 	scheme        string
+	authority     string
 	nextStreamID  uint32
-	HeaderDecoder HeaderDecoder
+	HeaderDecoder *HeaderDecoder
+	HeaderEncoder *HeaderEncoder
 
-	EnablePush           bool
-	MaxConcurrentStreams uint32
-	InitialWindowSize    uint32
-	MaxFrameSize         uint32
-	MaxHeaderListSize    uint32
+	EnablePush            bool
+	MaxConcurrentStreams  uint32
+	InitialWindowSize     uint32
+	MaxFrameSize          uint32
+	MaxHeaderListSize     uint32
+	EnableConnectProtocol bool
 
-	Window uint32
+	// peerSettings is closed once the peer's first SETTINGS frame has
+	// been applied, and failed once the connection has failed.
+	peerSettings chan struct{}
+	failed       chan struct{}
+
+	// Window is our connection-level receive window. sendWindow is the
+	// peer's, shared by all streams; windowCond signals changes to it and
+	// to the streams' send windows.
+	Window     uint32
+	sendWindow int64
+	windowCond *sync.Cond
+
+	Padding PaddingPolicy
+
+	LocalHeaderTableSize   uint32
+	LocalMaxHeaderListSize uint32
+	pendingSettings        [][]SettingsParameter
+
+	err               error
+	headerBlock       Frame
+	headerBlockSize   int
+	headerFields      []HeaderFieldFormat
+	continuationCount int
 }
 
+// maxContinuationFrames limits the number of CONTINUATION frames that may
+// follow a single HEADERS or PUSH_PROMISE frame.
+const maxContinuationFrames = 64
+
+// defaultWindowSize is the initial flow-control window size of RFC 9113
+// 6.9.2. We never change our own.
+const defaultWindowSize = 65535
+
+// maxWindowSize is the largest flow-control window a peer may grant.
+const maxWindowSize = 1<<31 - 1
+
+var (
+	errConnectionClosed = errors.New("connection closed")
+	errStreamClosed     = errors.New("stream closed")
+)
+
 func newConnection(conn *net.Conn, tls *tls.Conn, reader *bufio.Reader, writer *bufio.Writer, scheme string) (*Connection, error) {
 	var c Connection
-	c.Streams = make(map[uint32]Stream)
+	c.Streams = make(map[uint32]*Stream)
 	c.Conn = conn
 	c.Tls = tls
 	c.Reader = reader
 	c.Writer = writer
 	c.scheme = scheme
 	c.nextStreamID = 1
-	c.HeaderDecoder = HeaderDecoder{
-		DynamicTable: []HeaderField{},
-		MaxSize:      4096,
-	}
+	c.HeaderDecoder = NewHeaderDecoder()
+	c.HeaderEncoder = NewHeaderEncoder()
 	c.EnablePush = true
 	c.MaxConcurrentStreams = math.MaxUint32
 	c.InitialWindowSize = 65535
 	c.MaxFrameSize = 16384
 	c.MaxHeaderListSize = math.MaxUint32
+	c.peerSettings = make(chan struct{})
+	c.failed = make(chan struct{})
 
-	c.Window = c.InitialWindowSize
+	c.Window = defaultWindowSize
+	c.sendWindow = defaultWindowSize
+	c.windowCond = sync.NewCond(&c.mu)
+	c.Padding = NoPadding{}
+	c.LocalHeaderTableSize = 4096
+	c.LocalMaxHeaderListSize = 65536
 	return &c, nil
 }
 
+// Dialer opens connections, directly or through a proxy.
+type Dialer struct {
+	// Proxy returns the proxy to reach address through for an origin
+	// with the given scheme, or nil to connect directly. The proxy URL's
+	// scheme may be http, https, socks5 or socks5h.
+	Proxy func(scheme, address string) (*url.URL, error)
+
+	// ProxyTLSConfig is used for the TLS connection to an https proxy.
+	ProxyTLSConfig *tls.Config
+}
+
+// Dial and DialTls use the proxy configured in the environment.
+var defaultDialer = &Dialer{Proxy: ProxyFromEnvironment}
+
 func Dial(address string) (*Connection, error) {
-	conn, err := net.Dial("tcp", address)
+	return defaultDialer.Dial(address)
+}
+
+func DialTls(address string) (*Connection, error) {
+	return defaultDialer.DialTls(address)
+}
+
+func (d *Dialer) Dial(address string) (*Connection, error) {
+	conn, err := d.dial("http", address)
 	if err != nil {
 		return nil, err
 	}
-	return newConnection(&conn, nil, bufio.NewReader(conn), bufio.NewWriter(conn), "http")
+	c, err := newConnection(&conn, nil, bufio.NewReader(conn), bufio.NewWriter(conn), "http")
+	if err != nil {
+		return nil, err
+	}
+	c.authority = dialAuthority(address)
+	return c, nil
 }
 
-func DialTls(address string) (*Connection, error) {
-	conn, err := tls.Dial("tcp", address, &tls.Config{
+// DialTls runs TLS with ALPN over the connection to address, end to end
+// if it goes through a proxy.
+func (d *Dialer) DialTls(address string) (*Connection, error) {
+	raw, err := d.dial("https", address)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(address)
+	conn := tls.Client(raw, &tls.Config{
+		ServerName:         host,
 		NextProtos:         []string{"h2"},
 		InsecureSkipVerify: true,
 	})
+	if err := conn.Handshake(); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	c, err := newConnection(nil, conn, bufio.NewReader(conn), bufio.NewWriter(conn), "https")
 	if err != nil {
 		return nil, err
 	}
-	return newConnection(nil, conn, bufio.NewReader(conn), bufio.NewWriter(conn), "https")
+	c.authority = dialAuthority(address)
+	return c, nil
+}
+
+// dialAuthority returns the authority of the origin reached by dialing
+// address. A missing host means the local host.
+func dialAuthority(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// canonicalAuthority lowercases the host of authority and adds the default
+// port of scheme if it has none.
+func canonicalAuthority(scheme, authority string) string {
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		host = strings.Trim(authority, "[]")
+		port = "80"
+		if scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(strings.ToLower(host), port)
+}
+
+// netConn returns the underlying connection, or nil once it is closed.
+func (c *Connection) netConn() net.Conn {
+	if c.Tls != nil {
+		return c.Tls
+	}
+	if c.Conn != nil {
+		return *c.Conn
+	}
+	return nil
 }
 
 func (c *Connection) Close() {
@@ -82,52 +212,475 @@ func (c *Connection) Close() {
 }
 
 func (c *Connection) sendFrame(frame Frame) {
-	fmt.Printf("Send: %#v\n", frame)
-	c.Writer.Write(frame.Serialize())
+	c.sendFrames(frame)
+}
+
+// sendFrames writes frames back-to-back so that no other frame can be
+// interleaved between them.
+func (c *Connection) sendFrames(frames ...Frame) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.writeFrames(frames...)
+}
+
+func (c *Connection) writeFrames(frames ...Frame) {
+	for _, frame := range frames {
+		fmt.Printf("Send: %#v\n", frame)
+		c.Writer.Write(frame.Serialize())
+	}
 	c.Writer.Flush()
 }
 
-func (c *Connection) handleRecievedFrame(frame Frame) {
+// sendHeaderList encodes and sends a header list. Encoding happens while
+// holding the write lock so that header blocks reach the peer in the same
+// order as they update the encoder's dynamic table.
+func (c *Connection) sendHeaderList(sid uint32, endStream bool, hl HeaderList) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	block, err := c.HeaderEncoder.Encode(hl)
+	if err != nil {
+		return err
+	}
+	c.writeFrames(c.headerFrames(sid, endStream, block)...)
+	return nil
+}
+
+func (c *Connection) sendHeaders(sid uint32, endStream bool, block []byte) {
+	c.sendFrames(c.headerFrames(sid, endStream, block)...)
+}
+
+// peerMaxFrameSize returns the peer's SETTINGS_MAX_FRAME_SIZE.
+func (c *Connection) peerMaxFrameSize() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int(c.MaxFrameSize)
+}
+
+// headerFrames splits a header block into a HEADERS frame followed by as
+// many CONTINUATION frames as the peer's SETTINGS_MAX_FRAME_SIZE requires.
+func (c *Connection) headerFrames(sid uint32, endStream bool, block []byte) []Frame {
+	maxFrameSize := c.peerMaxFrameSize()
+	size := maxFrameSize
+	if _, padded := c.padLength(0); padded {
+		size -= 256
+	}
+	if size > len(block) {
+		size = len(block)
+	}
+
+	var flags Flags
+	if endStream {
+		flags |= FlagsEndStream
+	}
+	if size == len(block) {
+		flags |= FlagsEndHeaders
+	}
+	frames := []Frame{c.newHeadersFrame(sid, flags, block[:size])}
+	block = block[size:]
+
+	for len(block) > 0 {
+		size = maxFrameSize
+		flags = 0
+		if size >= len(block) {
+			size = len(block)
+			flags = FlagsEndHeaders
+		}
+		frames = append(frames, newContinuationFrame(sid, flags, block[:size]))
+		block = block[size:]
+	}
+
+	return frames
+}
+
+func newContinuationFrame(sid uint32, flags Flags, fragment []byte) *ContinuationFrame {
+	return &ContinuationFrame{
+		FrameBase: FrameBase{
+			Header: FrameHeader{
+				Length:           uint32(len(fragment)),
+				Type:             FrameTypeContinuation,
+				Flags:            flags,
+				StreamIdentifier: sid,
+			},
+		},
+		Payload: ContinuationPayload{
+			HeaderBlockFragment: fragment,
+		},
+	}
+}
+
+// maxHeaderBlockSize bounds the size of an encoded header block. No HPACK
+// representation decodes to less than a quarter of its encoded size, so a
+// larger block always exceeds SETTINGS_MAX_HEADER_LIST_SIZE.
+func (c *Connection) maxHeaderBlockSize() int {
+	return 4 * int(c.LocalMaxHeaderListSize)
+}
+
+// readHeaderBlock feeds a HEADERS or PUSH_PROMISE frame and its
+// CONTINUATION frames to the header decoder as they arrive. It returns the
+// frame that started the block once END_HEADERS has been seen, and nil
+// while the block is still incomplete. Other frames are returned as is.
+func (c *Connection) readHeaderBlock(frame Frame) (Frame, error) {
+	header := frame.GetHeader()
+
+	var fragment []byte
+	if c.headerBlock != nil {
+		cf, ok := frame.(*ContinuationFrame)
+		if !ok || header.StreamIdentifier != c.headerBlock.GetHeader().StreamIdentifier {
+			return nil, ConnectionError(ErrorCodeProtocolError)
+		}
+
+		c.continuationCount++
+		if c.continuationCount > maxContinuationFrames {
+			return nil, ConnectionError(ErrorCodeEnhanceYourCalm)
+		}
+		fragment = cf.Payload.HeaderBlockFragment
+	} else {
+		switch f := frame.(type) {
+		case *HeadersFrame:
+			fragment = f.Payload.HeaderBlockFragment
+		case *PushPromiseFrame:
+			fragment = f.Payload.HeaderBlockFragment
+		case *ContinuationFrame:
+			return nil, ConnectionError(ErrorCodeProtocolError)
+		default:
+			return frame, nil
+		}
+
+		c.headerBlock = frame
+		c.headerBlockSize = 0
+		c.continuationCount = 0
+		c.headerFields = nil
+		c.HeaderDecoder.SetEmitFunc(func(f HeaderFieldFormat) {
+			c.headerFields = append(c.headerFields, f)
+		})
+	}
+
+	c.headerBlockSize += len(fragment)
+	if c.headerBlockSize > c.maxHeaderBlockSize() {
+		return nil, ConnectionError(ErrorCodeEnhanceYourCalm)
+	}
+	if _, err := c.HeaderDecoder.Write(fragment); err != nil {
+		return nil, ConnectionError(ErrorCodeCompressionError)
+	}
+	if !header.Flags.Has(FlagsEndHeaders) {
+		return nil, nil
+	}
+
+	frame = c.headerBlock
+	frame.GetHeader().Flags |= FlagsEndHeaders
+	c.headerBlock = nil
+	return frame, nil
+}
+
+// finishHeaderBlock returns the fields decoded by readHeaderBlock once the
+// block is complete.
+func (c *Connection) finishHeaderBlock() ([]HeaderFieldFormat, error) {
+	fields := c.headerFields
+	c.headerFields = nil
+	if err := c.HeaderDecoder.Close(); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+func (c *Connection) handleRecievedFrame(frame Frame) error {
 	fmt.Printf("Recv: %#v\n", frame)
+
+	frame, err := c.readHeaderBlock(frame)
+	if err != nil {
+		return err
+	}
+	if frame == nil {
+		return nil
+	}
 	header := frame.GetHeader()
 
+	switch f := frame.(type) {
+	case *SettingsFrame:
+		if f.Header.Flags.Has(FlagsAck) {
+			c.handleSettingsAck()
+		}
+	case *HeadersFrame:
+		h, err := c.finishHeaderBlock()
+		if err == ErrHeaderListSize {
+			c.resetStream(header.StreamIdentifier, ErrorCodeProtocolError)
+			c.closeStreamWithError(header.StreamIdentifier, StreamError{header.StreamIdentifier, ErrorCodeProtocolError})
+			return nil
+		} else if err != nil {
+			return ConnectionError(ErrorCodeCompressionError)
+		}
+		frame = &HeaderListFrame{
+			HeadersFrame: f,
+			Fields:       h,
+		}
+	case *PushPromiseFrame:
+		// The header block still has to be decoded to keep the dynamic
+		// table in sync, but pushed streams are refused.
+		if _, err := c.finishHeaderBlock(); err != nil && err != ErrHeaderListSize {
+			return ConnectionError(ErrorCodeCompressionError)
+		}
+		c.resetStream(f.Payload.PromisedStreamID, ErrorCodeRefusedStream)
+		return nil
+	}
+
+	if f, ok := frame.(*WindowUpdateFrame); ok {
+		return c.handleWindowUpdate(f)
+	}
+
 	if d, ok := frame.(*DataFrame); ok {
+		if d.Header.Length > c.Window {
+			return ConnectionError(ErrorCodeFlowControlError)
+		}
 		c.Window -= d.Header.Length
-		if c.Window <= 0 {
-			wf := WindowUpdateFrame{
-				FrameBase: FrameBase{
-					Header: FrameHeader{
-						Length:           4,
-						Type:             FrameTypeWindowUpdate,
-						Flags:            0,
-						StreamIdentifier: 0,
-					},
-				},
-				Payload: WindowUpdatePayload{
-					WindowSizeIncrement: c.InitialWindowSize,
-				},
+		if c.Window < defaultWindowSize/2 {
+			c.sendWindowUpdate(0, defaultWindowSize-c.Window)
+			c.Window = defaultWindowSize
+		}
+	}
+
+	c.mu.Lock()
+	stream, ok := c.Streams[header.StreamIdentifier]
+	c.mu.Unlock()
+	if ok {
+		select {
+		case stream.recv <- frame:
+		case <-stream.done:
+		}
+	}
+	return nil
+}
+
+// handleWindowUpdate grows the connection's or a stream's send window.
+func (c *Connection) handleWindowUpdate(f *WindowUpdateFrame) error {
+	sid := f.Header.StreamIdentifier
+	increment := int64(f.Payload.WindowSizeIncrement)
+
+	c.mu.Lock()
+	if sid == 0 {
+		c.sendWindow += increment
+		overflow := c.sendWindow > maxWindowSize
+		c.windowCond.Broadcast()
+		c.mu.Unlock()
+		if increment == 0 {
+			return ConnectionError(ErrorCodeProtocolError)
+		} else if overflow {
+			return ConnectionError(ErrorCodeFlowControlError)
+		}
+		return nil
+	}
+
+	code := ErrorCodeNoError
+	if stream, ok := c.Streams[sid]; ok {
+		stream.sendWindow += increment
+		if increment == 0 {
+			code = ErrorCodeProtocolError
+		} else if stream.sendWindow > maxWindowSize {
+			code = ErrorCodeFlowControlError
+		}
+		c.windowCond.Broadcast()
+	}
+	c.mu.Unlock()
+
+	if code != ErrorCodeNoError {
+		c.resetStream(sid, code)
+		c.closeStreamWithError(sid, StreamError{sid, code})
+	}
+	return nil
+}
+
+func (c *Connection) sendWindowUpdate(sid uint32, increment uint32) {
+	wf := WindowUpdateFrame{
+		FrameBase: FrameBase{
+			Header: FrameHeader{
+				Length:           4,
+				Type:             FrameTypeWindowUpdate,
+				Flags:            0,
+				StreamIdentifier: sid,
+			},
+		},
+		Payload: WindowUpdatePayload{
+			WindowSizeIncrement: increment,
+		},
+	}
+	c.sendFrame(&wf)
+}
+
+// reserveSendWindow waits until both the connection and stream s may send
+// DATA and takes up to n octets of their send windows. check is called
+// with c.mu held each time before waiting, and ends the wait if it
+// returns an error.
+func (c *Connection) reserveSendWindow(s *Stream, n int, check func() error) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		if err := check(); err != nil {
+			return 0, err
+		}
+		if c.Streams[s.StreamID] != s {
+			if s.err != nil {
+				return 0, s.err
 			}
-			c.sendFrame(&wf)
-			c.Window += c.InitialWindowSize
+			return 0, errStreamClosed
 		}
+
+		window := c.sendWindow
+		if s.sendWindow < window {
+			window = s.sendWindow
+		}
+		if window > 0 {
+			if int64(n) < window {
+				window = int64(n)
+			}
+			c.sendWindow -= window
+			s.sendWindow -= window
+			return int(window), nil
+		}
+		c.windowCond.Wait()
+	}
+}
+
+// releaseSendWindow returns the unused part of a reservation.
+func (c *Connection) releaseSendWindow(s *Stream, n int) {
+	if n <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sendWindow += int64(n)
+	s.sendWindow += int64(n)
+	c.windowCond.Broadcast()
+}
+
+// wakeSendWindowWaiters makes reserveSendWindow call its check functions
+// again.
+func (c *Connection) wakeSendWindowWaiters() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.windowCond.Broadcast()
+}
+
+// fail tears the connection down after an unrecoverable error. A
+// ConnectionError is reported to the peer with a GOAWAY frame, and every
+// stream waiting for frames is released.
+func (c *Connection) fail(err error) {
+	if ce, ok := err.(ConnectionError); ok {
+		gf := GoawayFrame{
+			FrameBase: FrameBase{
+				Header: FrameHeader{
+					Length:           8,
+					Type:             FrameTypeGoaway,
+					Flags:            0,
+					StreamIdentifier: 0,
+				},
+			},
+			Payload: GoawayPayload{
+				LastStreamID:        0,
+				ErrorCode:           uint32(ce),
+				AdditionalDebugData: []byte{},
+			},
+		}
+		c.sendFrame(&gf)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		close(c.failed)
+	}
+	c.err = err
+	for sid, stream := range c.Streams {
+		stream.err = err
+		close(stream.recv)
+		delete(c.Streams, sid)
+	}
+	c.windowCond.Broadcast()
+}
+
+// closeStreamWithError releases the stream's reader with err.
+func (c *Connection) closeStreamWithError(sid uint32, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stream, ok := c.Streams[sid]; ok {
+		stream.err = err
+		close(stream.recv)
+		delete(c.Streams, sid)
+		c.windowCond.Broadcast()
 	}
+}
 
-	if stream, ok := c.Streams[header.StreamIdentifier]; ok {
-		stream.recv <- frame
+func (c *Connection) streamError(s *Stream) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s.err != nil {
+		return s.err
 	}
+	return errConnectionClosed
 }
 
-func (c *Connection) handleConnectionFrame() {
-	sid := uint32(0)
+func (c *Connection) resetStream(sid uint32, code ErrorCode) {
+	rf := RstStreamFrame{
+		FrameBase: FrameBase{
+			Header: FrameHeader{
+				Length:           4,
+				Type:             FrameTypeRstStream,
+				Flags:            0,
+				StreamIdentifier: sid,
+			},
+		},
+		Payload: RstStreamPayload{
+			ErrorCode: uint32(code),
+		},
+	}
+	c.sendFrame(&rf)
+}
+
+func (c *Connection) openStream() (*Stream, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return nil, c.err
+	}
 
-	frame := <-c.Streams[sid].recv
+	sid := c.nextStreamID
+	c.nextStreamID += 2
+	s := &Stream{
+		StreamID:   sid,
+		State:      idle,
+		recv:       make(chan Frame, 1),
+		done:       make(chan struct{}),
+		sendWindow: int64(c.InitialWindowSize),
+	}
+	c.Streams[sid] = s
+	return s, nil
+}
+
+// closeStream forgets a stream once its owner is done with it. Frames that
+// arrive for it later are dropped.
+func (c *Connection) closeStream(sid uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stream, ok := c.Streams[sid]; ok {
+		close(stream.done)
+		delete(c.Streams, sid)
+		c.windowCond.Broadcast()
+	}
+}
+
+func (c *Connection) handleConnectionFrame(frame Frame) {
 	if s, ok := frame.(*SettingsFrame); ok {
 		if !s.Header.Flags.Has(FlagsAck) {
 
 			for _, p := range s.Payload.Parameters {
 				switch p.Identifier {
 				case SettingsHeaderTableSize:
-					c.HeaderDecoder.MaxSize = int(p.Value)
+					// The peer's table size limits our encoder only.
+					c.writeMu.Lock()
+					c.HeaderEncoder.SetMaxDynamicTableSizeLimit(int(p.Value))
+					c.writeMu.Unlock()
 					break
 				case SettingsEnablePush:
 					if p.Value == 0 {
@@ -142,11 +695,26 @@ func (c *Connection) handleConnectionFrame() {
 					c.MaxConcurrentStreams = p.Value
 					break
 				case SettingsInitialWindowSize:
+					if p.Value > maxWindowSize {
+						// error
+						break
+					}
+					// Open streams' send windows change by the same
+					// amount as the initial window size.
+					c.mu.Lock()
+					delta := int64(p.Value) - int64(c.InitialWindowSize)
+					for _, stream := range c.Streams {
+						stream.sendWindow += delta
+					}
 					c.InitialWindowSize = p.Value
+					c.windowCond.Broadcast()
+					c.mu.Unlock()
 					break
 				case SettingsMaxFrameSize:
 					if 16384 <= p.Value && p.Value <= 16777215 {
+						c.mu.Lock()
 						c.MaxFrameSize = p.Value
+						c.mu.Unlock()
 					} else {
 						// error
 					}
@@ -154,6 +722,13 @@ func (c *Connection) handleConnectionFrame() {
 				case SettingsMaxHeaderListSize:
 					c.MaxHeaderListSize = p.Value
 					break
+				case SettingsEnableConnectProtocol:
+					if p.Value == 1 {
+						c.EnableConnectProtocol = true
+					} else if p.Value != 0 || c.EnableConnectProtocol {
+						// error
+					}
+					break
 				default:
 					// error
 				}
@@ -174,31 +749,33 @@ func (c *Connection) handleConnectionFrame() {
 				},
 			}
 			c.sendFrame(&sf)
+
+			select {
+			case <-c.peerSettings:
+			default:
+				close(c.peerSettings)
+			}
 		}
 	}
 }
 
-func (c *Connection) StartHTTP2() {
-	c.Writer.Write([]byte(HTTP2CoccectionPreface))
-
-	s := Stream{
-		StreamID: 0,
-		State:    idle,
-		recv:     make(chan Frame, 1),
+// waitPeerSettings waits until the peer's first SETTINGS frame has been
+// applied.
+func (c *Connection) waitPeerSettings() error {
+	select {
+	case <-c.peerSettings:
+		return nil
+	case <-c.failed:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.err
 	}
-	c.Streams[0] = s
-
-	go func(c *Connection) {
-		for {
-			frame, err := ReadFrame(c.Reader)
-			if err != nil {
-				log.Fatal(err)
-			}
-			c.handleRecievedFrame(frame)
-		}
-	}(c)
+}
 
-	sf1 := SettingsFrame{
+// SendSettings sends our SETTINGS to the peer. They take effect on our side
+// once the peer acknowledges them.
+func (c *Connection) SendSettings(params ...SettingsParameter) {
+	sf := SettingsFrame{
 		FrameBase: FrameBase{
 			Header: FrameHeader{
 				Length:           0,
@@ -208,129 +785,220 @@ func (c *Connection) StartHTTP2() {
 			},
 		},
 		Payload: SettingsPayload{
-			Parameters: []SettingsParameter{},
+			Parameters: params,
 		},
 	}
+	sf.Header.Length = uint32(len(sf.Payload.Serialize()))
+
+	c.mu.Lock()
+	c.pendingSettings = append(c.pendingSettings, params)
+	c.mu.Unlock()
 
-	c.sendFrame(&sf1)
+	c.sendFrame(&sf)
+}
+
+// handleSettingsAck applies the oldest unacknowledged SETTINGS. It runs on
+// the read loop so that the decoder sees the new limits exactly from the
+// first header block following the acknowledgement.
+func (c *Connection) handleSettingsAck() {
+	c.mu.Lock()
+	if len(c.pendingSettings) == 0 {
+		c.mu.Unlock()
+		return
+	}
+	params := c.pendingSettings[0]
+	c.pendingSettings = c.pendingSettings[1:]
+	c.mu.Unlock()
+
+	for _, p := range params {
+		switch p.Identifier {
+		case SettingsHeaderTableSize:
+			c.HeaderDecoder.SetMaxDynamicTableSizeLimit(int(p.Value))
+		}
+	}
+}
+
+func (c *Connection) StartHTTP2() {
+	c.HeaderDecoder.MaxStringLength = int(c.LocalMaxHeaderListSize)
+	c.HeaderDecoder.MaxHeaderListSize = int(c.LocalMaxHeaderListSize)
+
+	c.Writer.Write([]byte(HTTP2CoccectionPreface))
+
+	s := &Stream{
+		StreamID: 0,
+		State:    idle,
+		recv:     make(chan Frame, 1),
+		done:     make(chan struct{}),
+	}
+	c.mu.Lock()
+	c.Streams[0] = s
+	c.mu.Unlock()
 
 	go func(c *Connection) {
 		for {
-			c.handleConnectionFrame()
+			frame, err := ReadFrame(c.Reader)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			if err := c.handleRecievedFrame(frame); err != nil {
+				c.fail(err)
+				return
+			}
 		}
 	}(c)
 
+	c.SendSettings(
+		SettingsParameter{SettingsHeaderTableSize, c.LocalHeaderTableSize},
+		SettingsParameter{SettingsMaxHeaderListSize, c.LocalMaxHeaderListSize},
+	)
+
+	go func(c *Connection, recv chan Frame) {
+		for frame := range recv {
+			c.handleConnectionFrame(frame)
+		}
+	}(c, s.recv)
+
 }
 
 type Response struct {
 	Header map[string][]string
 	Body   string
+
+	// Fields holds the header fields in the order they arrived, along with
+	// how each was represented.
+	Fields []HeaderFieldFormat
 }
 
-func (c *Connection) Request(method string, requestPath string, headers []HeaderField) (*Response, error) {
+// RequestURL sends a request for u, which must be an absolute URL of this
+// connection's origin, or "*" for a server-wide OPTIONS request. :scheme,
+// :authority and :path are taken from the URL.
+func (c *Connection) RequestURL(method string, u *url.URL, headers []HeaderField) (*Response, error) {
+	if u.Scheme == "" && u.Host == "" && (u.Path == "*" || u.Opaque == "*") {
+		if method != "OPTIONS" {
+			return nil, fmt.Errorf("%s request for \"*\"", method)
+		}
+		return c.request(method, "*", c.authority, headers)
+	}
 
-	sid := c.nextStreamID
-	c.nextStreamID += 2
-	s := Stream{
-		StreamID: sid,
-		State:    idle,
-		recv:     make(chan Frame, 1),
+	if err := c.checkOrigin(u); err != nil {
+		return nil, err
 	}
-	c.Streams[sid] = s
+	return c.request(method, u.RequestURI(), strings.ToLower(u.Host), headers)
+}
 
-	hs := append(
-		[]HeaderField{
-			HeaderField{":method", method},
-			HeaderField{":scheme", c.scheme},
-			HeaderField{":path", requestPath},
-		},
-		headers...,
-	)
+// checkOrigin reports an error unless u is an absolute URL of this
+// connection's origin.
+func (c *Connection) checkOrigin(u *url.URL) error {
+	if u.User != nil {
+		return fmt.Errorf("url %q has user information", u.Redacted())
+	}
+	if u.Scheme != c.scheme || u.Host == "" {
+		return fmt.Errorf("url %q does not match the connection's origin", u.Redacted())
+	}
+	if c.authority != "" && canonicalAuthority(u.Scheme, u.Host) != canonicalAuthority(c.scheme, c.authority) {
+		return fmt.Errorf("url %q does not match the connection's origin", u.Redacted())
+	}
+	return nil
+}
 
-	hl, err := EncodeHeaders(hs)
+// RequestRawURL is like RequestURL, but parses the URL first.
+func (c *Connection) RequestRawURL(method string, rawurl string, headers []HeaderField) (*Response, error) {
+	u, err := url.Parse(rawurl)
 	if err != nil {
 		return nil, err
 	}
+	return c.RequestURL(method, u, headers)
+}
 
-	hf := HeadersFrame{
-		FrameBase: FrameBase{
-			Header: FrameHeader{
-				Length:           0,
-				Type:             FrameTypeHeaders,
-				Flags:            FlagsEndStream | FlagsEndHeaders,
-				StreamIdentifier: sid,
-			},
-		},
-		Payload: HeadersPayload{
-			PadLength:           0,
-			E:                   0,
-			StreamDependency:    0,
-			Weight:              0,
-			HeaderBlockFragment: hl,
-		},
+// Request sends a request for requestPath. A host header is sent as
+// :authority.
+func (c *Connection) Request(method string, requestPath string, headers []HeaderField) (*Response, error) {
+	return c.request(method, requestPath, "", headers)
+}
+
+func (c *Connection) request(method string, requestPath string, authority string, headers []HeaderField) (*Response, error) {
+	hs := []HeaderField{
+		{":method", method},
+		{":scheme", c.scheme},
+	}
+	if authority != "" {
+		hs = append(hs, HeaderField{":authority", authority})
+	}
+	hs = append(hs, HeaderField{":path", requestPath})
+	hs, err := normalizeRequestHeaders(append(hs, headers...))
+	if err != nil {
+		return nil, err
 	}
-	hf.Header.Length = uint32(len(hf.Payload.Serialize()))
 
-	c.sendFrame(&hf)
+	s, err := c.openStream()
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeStream(s.StreamID)
+	sid := s.StreamID
+
+	if err := c.sendHeaderList(sid, true, hs); err != nil {
+		return nil, err
+	}
 
 	response := Response{
 		Header: make(map[string][]string),
 		Body:   "",
 	}
 	readingHeader := true
-	headerBlockFragment := []byte{}
-	window := c.InitialWindowSize
+	// Our stream receive window. We never announce a different initial
+	// window size, so it starts at the default.
+	window := defaultWindowSize
 
 	for {
-		frame := <-c.Streams[sid].recv
-
-		if readingHeader {
-			if f, ok := frame.(*HeadersFrame); ok {
-				headerBlockFragment = append(headerBlockFragment, f.Payload.HeaderBlockFragment...)
-			} else if c, ok := frame.(*ContinuationFrame); ok {
-				headerBlockFragment = append(headerBlockFragment, c.Payload.HeaderBlockFragment...)
-			} else {
-				// frame error ?
-				return nil, fmt.Errorf("invalid frame type : %d", frame.GetHeader().Type)
+		frame, ok := <-s.recv
+		if !ok {
+			return nil, c.streamError(s)
+		}
+
+		switch f := frame.(type) {
+		case *HeaderListFrame:
+			// Interim 1xx responses are skipped; a header block after
+			// the final response carries trailers.
+			status, err := validateResponseHeaders(f.Fields, !readingHeader)
+			if err == nil && readingHeader && 100 <= status && status < 200 && f.Header.Flags.Has(FlagsEndStream) {
+				err = HeaderFieldError{":status", "informational response ends the stream"}
+			} else if err == nil && !readingHeader && !f.Header.Flags.Has(FlagsEndStream) {
+				err = HeaderFieldError{"", "trailers do not end the stream"}
 			}
-		} else {
-			if d, ok := frame.(*DataFrame); ok {
-				window -= d.Header.Length
-				response.Body = response.Body + string(d.Payload.Data)
-			} else {
-				// frame error ?
-				return nil, fmt.Errorf("invalid frame type : %d", frame.GetHeader().Type)
+			if err != nil {
+				c.resetStream(sid, ErrorCodeProtocolError)
+				return nil, StreamError{sid, ErrorCodeProtocolError}
+			}
+			if 100 <= status && status < 200 {
+				continue
 			}
-		}
 
-		if frame.GetHeader().Flags.Has(FlagsEndHeaders) {
 			readingHeader = false
-			header := c.HeaderDecoder.Decode(headerBlockFragment)
-			for key, value := range header {
-				if _, ok := response.Header[key]; ok {
-					response.Header[key] = append(response.Header[key], value...)
-				} else {
-					response.Header[key] = value
-				}
+			for _, h := range f.Fields {
+				addHeaderValue(response.Header, h.Name, h.Value)
 			}
-		} else if frame.GetHeader().Flags.Has(FlagsEndStream) {
-			break
-		} else if window <= 0 {
-			wf := WindowUpdateFrame{
-				FrameBase: FrameBase{
-					Header: FrameHeader{
-						Length:           4,
-						Type:             FrameTypeWindowUpdate,
-						Flags:            0,
-						StreamIdentifier: sid,
-					},
-				},
-				Payload: WindowUpdatePayload{
-					WindowSizeIncrement: c.InitialWindowSize,
-				},
+			response.Fields = append(response.Fields, f.Fields...)
+		case *DataFrame:
+			if readingHeader {
+				c.resetStream(sid, ErrorCodeProtocolError)
+				return nil, StreamError{sid, ErrorCodeProtocolError}
 			}
-			c.sendFrame(&wf)
-			window += c.InitialWindowSize
+			window -= int(f.Header.Length)
+			response.Body = response.Body + string(f.Payload.Data)
+		case *RstStreamFrame:
+			return nil, StreamError{sid, ErrorCode(f.Payload.ErrorCode)}
+		default:
+			// frame error ?
+			return nil, fmt.Errorf("invalid frame type : %d", frame.GetHeader().Type)
+		}
+
+		if frame.GetHeader().Flags.Has(FlagsEndStream) {
+			break
+		} else if window < defaultWindowSize/2 {
+			c.sendWindowUpdate(sid, uint32(defaultWindowSize-window))
+			window = defaultWindowSize
 		}
 	}
 
@@ -353,4 +1021,18 @@ type Stream struct {
 	StreamID uint32
 	State    StreamState
 	recv     chan Frame
+	done     chan struct{}
+	err      error
+
+	// sendWindow is the peer's flow-control window for the stream,
+	// guarded by Connection.mu.
+	sendWindow int64
+}
+
+// HeaderListFrame is a HEADERS frame whose complete header block has
+// already been decoded by the connection's read loop. Decoding there keeps
+// the HPACK dynamic table updates in the order the blocks arrived.
+type HeaderListFrame struct {
+	*HeadersFrame
+	Fields []HeaderFieldFormat
 }
@@ -2,11 +2,15 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 )
 
 const HTTP2CoccectionPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
 
+var errInvalidPadding = errors.New("invalid padding")
+
 type FrameType uint8
 
 const (
@@ -97,7 +101,7 @@ type DataFrame struct {
 func (frame *DataFrame) Serialize() []byte {
 	header := frame.Header.Serialize()
 
-	return append(header, frame.Payload.Serialize()...)
+	return append(header, frame.Payload.Serialize(frame.Header.Flags.Has(FlagsPadded))...)
 }
 
 func (frame *DataFrame) Deserialize(header []byte, payload []byte) error {
@@ -105,7 +109,7 @@ func (frame *DataFrame) Deserialize(header []byte, payload []byte) error {
 		return err
 	}
 
-	if err := frame.Payload.Deserialize(payload); err != nil {
+	if err := frame.Payload.Deserialize(payload, frame.Header.Flags.Has(FlagsPadded)); err != nil {
 		return err
 	}
 
@@ -113,15 +117,32 @@ func (frame *DataFrame) Deserialize(header []byte, payload []byte) error {
 }
 
 type DataPayload struct {
-	Data []byte
+	PadLength byte
+	Data      []byte
 }
 
-func (p *DataPayload) Serialize() []byte {
-	return p.Data
+func (p *DataPayload) Serialize(padded bool) []byte {
+	if !padded {
+		return p.Data
+	}
+
+	output := make([]byte, 1+len(p.Data)+int(p.PadLength))
+	output[0] = p.PadLength
+	copy(output[1:], p.Data)
+	return output
 }
 
-func (p *DataPayload) Deserialize(input []byte) error {
-	p.Data = input
+func (p *DataPayload) Deserialize(input []byte, padded bool) error {
+	if padded {
+		if len(input) == 0 || len(input) <= int(input[0]) {
+			return errInvalidPadding
+		}
+		p.PadLength = input[0]
+		p.Data = input[1 : len(input)-int(p.PadLength)]
+	} else {
+		p.PadLength = 0
+		p.Data = input
+	}
 	return nil
 }
 
@@ -135,7 +156,7 @@ type HeadersFrame struct {
 func (frame *HeadersFrame) Serialize() []byte {
 	header := frame.Header.Serialize()
 
-	return append(header, frame.Payload.Serialize()...)
+	return append(header, frame.Payload.Serialize(frame.Header.Flags.Has(FlagsPadded), frame.Header.Flags.Has(FlagsFlagsPriority))...)
 }
 
 func (frame *HeadersFrame) Deserialize(header []byte, payload []byte) error {
@@ -158,15 +179,40 @@ type HeadersPayload struct {
 	HeaderBlockFragment []byte
 }
 
-func (h *HeadersPayload) Serialize() []byte {
-	output := make([]byte, len(h.HeaderBlockFragment))
-	copy(output[0:], h.HeaderBlockFragment)
+func (h *HeadersPayload) Serialize(padded bool, priority bool) []byte {
+	size := len(h.HeaderBlockFragment)
+	if padded {
+		size += 1 + int(h.PadLength)
+	}
+	if priority {
+		size += 5
+	}
+	output := make([]byte, size)
+
+	i := 0
+	if padded {
+		output[i] = h.PadLength
+		i++
+	}
+
+	if priority {
+		binary.BigEndian.PutUint32(output[i:i+4], h.StreamDependency&0x7fffffff|uint32(h.E&0x01)<<31)
+		i += 4
+
+		output[i] = h.Weight
+		i++
+	}
+
+	copy(output[i:], h.HeaderBlockFragment)
 	return output
 }
 
 func (h *HeadersPayload) Deserialize(input []byte, padded bool, priority bool) error {
 	i := 0
 	if padded {
+		if len(input) == 0 {
+			return errInvalidPadding
+		}
 		h.PadLength = input[i]
 		i++
 	} else {
@@ -183,7 +229,10 @@ func (h *HeadersPayload) Deserialize(input []byte, padded bool, priority bool) e
 		i++
 	}
 
-	h.HeaderBlockFragment = input[i : len(input)-i-int(h.PadLength)]
+	if len(input)-i < int(h.PadLength) {
+		return errInvalidPadding
+	}
+	h.HeaderBlockFragment = input[i : len(input)-int(h.PadLength)]
 	return nil
 }
 
@@ -414,8 +463,12 @@ func (p *PushPromisePayload) Deserialize(input []byte, padded bool) error {
 		i++
 	}
 
+	if len(input)-i < 4+int(padLength) {
+		return errInvalidPadding
+	}
 	p.PromisedStreamID = binary.BigEndian.Uint32(input[i:i+4]) & 0x7fffffff
-	p.HeaderBlockFragment = input[i : len(input)-i-int(padLength)]
+	i += 4
+	p.HeaderBlockFragment = input[i : len(input)-int(padLength)]
 	return nil
 }
 
@@ -590,7 +643,7 @@ type ContinuationPayload struct {
 
 func (p *ContinuationPayload) Serialize() []byte {
 	output := make([]byte, len(p.HeaderBlockFragment))
-	copy(output[4:], p.HeaderBlockFragment)
+	copy(output[0:], p.HeaderBlockFragment)
 	return output
 }
 
@@ -647,6 +700,49 @@ const (
 	ErrorCodeHTTP11Required     ErrorCode = 0x0d
 )
 
+var errorCodeNames = map[ErrorCode]string{
+	ErrorCodeNoError:            "NO_ERROR",
+	ErrorCodeProtocolError:      "PROTOCOL_ERROR",
+	ErrorCodeInternalError:      "INTERNAL_ERROR",
+	ErrorCodeFlowControlError:   "FLOW_CONTROL_ERROR",
+	ErrorCodeSettingsTimeout:    "SETTINGS_TIMEOUT",
+	ErrorCodeStreamClosed:       "STREAM_CLOSED",
+	ErrorCodeFrameSizeError:     "FRAME_SIZE_ERROR",
+	ErrorCodeRefusedStream:      "REFUSED_STREAM",
+	ErrorCodeCancel:             "CANCEL",
+	ErrorCodeCompressionError:   "COMPRESSION_ERROR",
+	ErrorCodeConnectError:       "CONNECT_ERROR",
+	ErrorCodeEnhanceYourCalm:    "ENHANCE_YOUR_CALM",
+	ErrorCodeInadequateSecurity: "INADEQUATE_SECURITY",
+	ErrorCodeHTTP11Required:     "HTTP_1_1_REQUIRED",
+}
+
+func (e ErrorCode) String() string {
+	if name, ok := errorCodeNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown error code 0x%x", uint32(e))
+}
+
+// ConnectionError is an error that terminates the whole connection with
+// a GOAWAY frame.
+type ConnectionError ErrorCode
+
+func (e ConnectionError) Error() string {
+	return fmt.Sprintf("connection error: %s", ErrorCode(e))
+}
+
+// StreamError is an error that terminates a single stream with a
+// RST_STREAM frame.
+type StreamError struct {
+	StreamID uint32
+	Code     ErrorCode
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("stream error: stream ID %d; %s", e.StreamID, e.Code)
+}
+
 type SettingsParameterType uint16
 
 const (
@@ -656,6 +752,9 @@ const (
 	SettingsInitialWindowSize    SettingsParameterType = 0x4
 	SettingsMaxFrameSize         SettingsParameterType = 0x5
 	SettingsMaxHeaderListSize    SettingsParameterType = 0x6
+
+	// RFC 8441
+	SettingsEnableConnectProtocol SettingsParameterType = 0x8
 )
 
 func ReadFrame(reader io.Reader) (Frame, error) {
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPaddedFrameRoundTrip(t *testing.T) {
+	c, err := newConnection(nil, nil, nil, nil, "http")
+	assert.Nil(t, err)
+
+	testcases := []struct {
+		policy   PaddingPolicy
+		padded   bool
+		expected int
+	}{
+		{NoPadding{}, false, 5},
+		{FixedPadding{10}, true, 16},
+		{BucketPadding{32}, true, 32},
+		{FixedPadding{1000}, true, 261},
+	}
+
+	for i := 0; i < len(testcases); i++ {
+		tc := testcases[i]
+		c.Padding = tc.policy
+
+		frames := []Frame{
+			c.newDataFrame(1, FlagsEndStream, []byte("hello")),
+			c.newHeadersFrame(1, FlagsEndHeaders, []byte("hello")),
+		}
+		for _, f := range frames {
+			assert.Equal(t, tc.padded, f.GetHeader().Flags.Has(FlagsPadded))
+			assert.Equal(t, uint32(tc.expected), f.GetHeader().Length)
+
+			actual, err := ReadFrame(bytes.NewReader(f.Serialize()))
+			assert.Nil(t, err)
+			switch a := actual.(type) {
+			case *DataFrame:
+				assert.Equal(t, []byte("hello"), a.Payload.Data)
+			case *HeadersFrame:
+				assert.Equal(t, []byte("hello"), a.Payload.HeaderBlockFragment)
+			default:
+				t.Fatalf("unexpected frame %#v", actual)
+			}
+		}
+	}
+}
+
+func TestRandomPadding(t *testing.T) {
+	p := RandomPadding{16}
+	for i := 0; i < 100; i++ {
+		n, padded := p.Pad(100)
+		assert.True(t, padded)
+		assert.True(t, 0 <= n && n <= 16)
+	}
+}
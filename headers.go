@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HeaderFieldError reports a header field that may not be sent, or a
+// received one that makes the message malformed (RFC 9113 8.2, 8.3).
+type HeaderFieldError struct {
+	Name   string
+	Reason string
+}
+
+func (e HeaderFieldError) Error() string {
+	return fmt.Sprintf("invalid header field %q: %s", e.Name, e.Reason)
+}
+
+// connectionSpecificHeaders may not appear in HTTP/2 messages.
+var connectionSpecificHeaders = map[string]bool{
+	"connection":        true,
+	"proxy-connection":  true,
+	"keep-alive":        true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+var requestPseudoHeaders = map[string]bool{
+	":method":    true,
+	":scheme":    true,
+	":authority": true,
+	":path":      true,
+	":protocol":  true,
+}
+
+// checkFieldName reports why name is not a valid lowercase field name, or
+// returns "".
+func checkFieldName(name string) string {
+	if name == "" {
+		return "empty name"
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case 'A' <= c && c <= 'Z':
+			return "uppercase name"
+		case c == ':' && i == 0:
+		case c <= 0x20 || c >= 0x7f || strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) >= 0:
+			return "invalid character in name"
+		}
+	}
+	return ""
+}
+
+// checkFieldValue reports why value is not a valid field value, or
+// returns "".
+func checkFieldValue(value string) string {
+	if strings.ContainsAny(value, "\x00\r\n") {
+		return "NUL, CR or LF in value"
+	}
+	if value != strings.Trim(value, " \t") {
+		return "leading or trailing whitespace in value"
+	}
+	return ""
+}
+
+// normalizeRequestHeaders validates the header list of an outgoing request.
+// Names are lowercased, surrounding whitespace is trimmed from values, and
+// connection-specific fields are dropped, including the fields a
+// Connection header nominates and TE values other than "trailers".
+// Cookie fields are crumbled into one field per cookie so that the
+// unchanged ones compress well, and Host is turned into :authority.
+// Pseudo-header fields must come first and appear at most once.
+func normalizeRequestHeaders(hl []HeaderField) ([]HeaderField, error) {
+	nominated := make(map[string]bool)
+	authority, host := "", ""
+	for _, h := range hl {
+		switch strings.ToLower(h.Name) {
+		case "connection":
+			for _, token := range strings.Split(h.Value, ",") {
+				nominated[strings.ToLower(strings.TrimSpace(token))] = true
+			}
+		case ":authority":
+			authority = h.Value
+		case "host":
+			host = strings.ToLower(strings.Trim(h.Value, " \t"))
+		}
+	}
+	if authority != "" && host != "" && !strings.EqualFold(authority, host) {
+		return nil, HeaderFieldError{"host", "does not match :authority"}
+	}
+
+	result := make([]HeaderField, 0, len(hl))
+	pseudo := make(map[string]bool)
+	regular := false
+	for _, h := range hl {
+		name := strings.ToLower(h.Name)
+		value := strings.Trim(h.Value, " \t")
+
+		if reason := checkFieldName(name); reason != "" {
+			return nil, HeaderFieldError{h.Name, reason}
+		}
+		if reason := checkFieldValue(value); reason != "" {
+			return nil, HeaderFieldError{h.Name, reason}
+		}
+
+		if strings.HasPrefix(name, ":") {
+			if !requestPseudoHeaders[name] {
+				return nil, HeaderFieldError{h.Name, "unknown pseudo-header field"}
+			}
+			if regular {
+				return nil, HeaderFieldError{h.Name, "pseudo-header field after regular field"}
+			}
+			if pseudo[name] {
+				return nil, HeaderFieldError{h.Name, "duplicate pseudo-header field"}
+			}
+			pseudo[name] = true
+		} else {
+			regular = true
+			if connectionSpecificHeaders[name] || nominated[name] || name == "host" {
+				continue
+			}
+			if name == "cookie" {
+				result = appendCookieCrumbs(result, value)
+				continue
+			}
+			if name == "te" {
+				if !strings.EqualFold(value, "trailers") {
+					continue
+				}
+				value = "trailers"
+			}
+		}
+
+		result = append(result, HeaderField{name, value})
+	}
+
+	if authority == "" && host != "" {
+		i := 0
+		for i < len(result) && strings.HasPrefix(result[i].Name, ":") {
+			i++
+		}
+		result = append(result[:i], append([]HeaderField{{":authority", host}}, result[i:]...)...)
+	}
+	return result, nil
+}
+
+// validateResponseHeaders checks a received response header section, or a
+// trailer section if trailers is set, and returns the status code.
+func validateResponseHeaders(fields []HeaderFieldFormat, trailers bool) (int, error) {
+	status := ""
+	regular := false
+	for _, f := range fields {
+		if reason := checkFieldName(f.Name); reason != "" {
+			return 0, HeaderFieldError{f.Name, reason}
+		}
+		if reason := checkFieldValue(f.Value); reason != "" {
+			return 0, HeaderFieldError{f.Name, reason}
+		}
+
+		if strings.HasPrefix(f.Name, ":") {
+			switch {
+			case f.Name != ":status" || trailers:
+				return 0, HeaderFieldError{f.Name, "unexpected pseudo-header field"}
+			case regular:
+				return 0, HeaderFieldError{f.Name, "pseudo-header field after regular field"}
+			case status != "":
+				return 0, HeaderFieldError{f.Name, "duplicate pseudo-header field"}
+			}
+			status = f.Value
+			continue
+		}
+
+		regular = true
+		if connectionSpecificHeaders[f.Name] || f.Name == "te" {
+			return 0, HeaderFieldError{f.Name, "connection-specific header field"}
+		}
+	}
+
+	if trailers {
+		return 0, nil
+	}
+	if len(status) != 3 || strings.Trim(status, "0123456789") != "" || status[0] == '0' {
+		return 0, HeaderFieldError{":status", "missing or invalid status"}
+	}
+	return int(status[0]-'0')*100 + int(status[1]-'0')*10 + int(status[2]-'0'), nil
+}
+
+// appendCookieCrumbs splits a Cookie value into separate fields, as RFC
+// 9113 8.2.3 allows.
+func appendCookieCrumbs(hl []HeaderField, value string) []HeaderField {
+	for _, crumb := range strings.Split(value, ";") {
+		if crumb = strings.Trim(crumb, " \t"); crumb != "" {
+			hl = append(hl, HeaderField{"cookie", crumb})
+		}
+	}
+	return hl
+}
+
+// addHeaderValue adds a received field to header. Cookie fields are joined
+// back into a single value with "; ".
+func addHeaderValue(header map[string][]string, name, value string) {
+	if name == "cookie" && len(header[name]) > 0 {
+		header[name][0] += "; " + value
+		return
+	}
+	header[name] = append(header[name], value)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeRequestHeaders(t *testing.T) {
+	actual, err := normalizeRequestHeaders([]HeaderField{
+		{":method", "GET"},
+		{":path", "/"},
+		{"User-Agent", " http2client "},
+		{"Connection", "keep-alive, X-Hop"},
+		{"keep-alive", "timeout=5"},
+		{"x-hop", "1"},
+		{"transfer-encoding", "chunked"},
+		{"upgrade", "h2c"},
+		{"te", "gzip"},
+		{"TE", "Trailers"},
+		{"x-empty", ""},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []HeaderField{
+		{":method", "GET"},
+		{":path", "/"},
+		{"user-agent", "http2client"},
+		{"te", "trailers"},
+		{"x-empty", ""},
+	}, actual)
+
+	testcases := []struct {
+		input  []HeaderField
+		reason string
+	}{
+		{[]HeaderField{{"", "x"}}, "empty name"},
+		{[]HeaderField{{"x y", "x"}}, "invalid character in name"},
+		{[]HeaderField{{"x:y", "x"}}, "invalid character in name"},
+		{[]HeaderField{{"x-crlf", "a\r\nx-injected: 1"}}, "NUL, CR or LF in value"},
+		{[]HeaderField{{"x-nul", "a\x00b"}}, "NUL, CR or LF in value"},
+		{[]HeaderField{{"x", "1"}, {":path", "/"}}, "pseudo-header field after regular field"},
+		{[]HeaderField{{":path", "/"}, {":path", "/"}}, "duplicate pseudo-header field"},
+		{[]HeaderField{{":status", "200"}}, "unknown pseudo-header field"},
+	}
+	for i := 0; i < len(testcases); i++ {
+		tc := testcases[i]
+		_, err := normalizeRequestHeaders(tc.input)
+		if assert.IsType(t, HeaderFieldError{}, err, "%d", i) {
+			assert.Equal(t, tc.reason, err.(HeaderFieldError).Reason, "%d", i)
+		}
+	}
+}
+
+func TestValidateResponseHeaders(t *testing.T) {
+	fields := func(hl ...HeaderField) []HeaderFieldFormat {
+		var result []HeaderFieldFormat
+		for _, h := range hl {
+			result = append(result, HeaderFieldFormat{HeaderField: h})
+		}
+		return result
+	}
+
+	status, err := validateResponseHeaders(fields(HeaderField{":status", "204"}, HeaderField{"server", "test"}), false)
+	assert.Nil(t, err)
+	assert.Equal(t, 204, status)
+
+	_, err = validateResponseHeaders(fields(HeaderField{"grpc-status", "0"}), true)
+	assert.Nil(t, err)
+
+	testcases := []struct {
+		fields   []HeaderFieldFormat
+		trailers bool
+	}{
+		{fields(HeaderField{"server", "test"}), false},
+		{fields(HeaderField{":status", "200"}, HeaderField{":status", "200"}), false},
+		{fields(HeaderField{":status", "20"}), false},
+		{fields(HeaderField{":status", "abc"}), false},
+		{fields(HeaderField{"server", "test"}, HeaderField{":status", "200"}), false},
+		{fields(HeaderField{":status", "200"}, HeaderField{":path", "/"}), false},
+		{fields(HeaderField{":status", "200"}, HeaderField{"Server", "test"}), false},
+		{fields(HeaderField{":status", "200"}, HeaderField{"server", "a\nb"}), false},
+		{fields(HeaderField{":status", "200"}, HeaderField{"server", "test "}), false},
+		{fields(HeaderField{":status", "200"}, HeaderField{"connection", "close"}), false},
+		{fields(HeaderField{":status", "200"}, HeaderField{"transfer-encoding", "chunked"}), false},
+		{fields(HeaderField{":status", "200"}), true},
+	}
+	for i := 0; i < len(testcases); i++ {
+		tc := testcases[i]
+		_, err := validateResponseHeaders(tc.fields, tc.trailers)
+		assert.IsType(t, HeaderFieldError{}, err, "%d", i)
+	}
+}
+
+func TestCookieCrumbs(t *testing.T) {
+	actual, err := normalizeRequestHeaders([]HeaderField{
+		{":method", "GET"},
+		{"Cookie", "session=0123456789abcdef0123456789abcdef; theme=dark;;  lang=en "},
+		{"cookie", "tracking=1"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []HeaderField{
+		{":method", "GET"},
+		{"cookie", "session=0123456789abcdef0123456789abcdef"},
+		{"cookie", "theme=dark"},
+		{"cookie", "lang=en"},
+		{"cookie", "tracking=1"},
+	}, actual)
+
+	header := make(map[string][]string)
+	for _, h := range actual[1:] {
+		addHeaderValue(header, h.Name, h.Value)
+	}
+	addHeaderValue(header, "set-cookie", "a=1")
+	addHeaderValue(header, "set-cookie", "b=2")
+	assert.Equal(t, map[string][]string{
+		"cookie":     {"session=0123456789abcdef0123456789abcdef; theme=dark; lang=en; tracking=1"},
+		"set-cookie": {"a=1", "b=2"},
+	}, header)
+}
+
+func BenchmarkCookieCrumbs(b *testing.B) {
+	// The session cookie stays in the dynamic table while the short-lived
+	// one changes on every request.
+	e := NewHeaderEncoder()
+	size := 0
+	for i := 0; i < b.N; i++ {
+		hl, _ := normalizeRequestHeaders([]HeaderField{
+			{"cookie", "session=0123456789abcdef0123456789abcdef; preferences=theme-dark-lang-en-tz-utc; csrf=" + string(rune('a'+i%26))},
+		})
+		block, _ := e.Encode(hl)
+		size += len(block)
+	}
+	b.ReportMetric(float64(size)/float64(b.N), "bytes/op")
+}
+
+func TestNormalizeHostHeader(t *testing.T) {
+	actual, err := normalizeRequestHeaders([]HeaderField{{":authority", "example.com"}, {"host", "Example.com"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []HeaderField{{":authority", "example.com"}}, actual)
+
+	_, err = normalizeRequestHeaders([]HeaderField{{":authority", "example.com"}, {"host", "example.org"}})
+	assert.Equal(t, HeaderFieldError{"host", "does not match :authority"}, err)
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
-	"log"
+	"math"
 	"strings"
 )
 
@@ -22,23 +22,49 @@ func EncodeInteger(value int, n int) []byte {
 	return result
 }
 
-func DecodeInteger(data []byte, n int) (int, int) {
-	var v int
+var (
+	errTruncated       = errors.New("truncated header block")
+	errIntegerOverflow = errors.New("integer overflow")
+	errInvalidIndex    = errors.New("invalid table index")
+	errStringLength    = errors.New("string literal too long")
+	errTableSizeUpdate = errors.New("invalid dynamic table size update")
+
+	// ErrHeaderListSize is returned by HeaderDecoder.Decode when the decoded
+	// header list is larger than MaxHeaderListSize. The whole block has still
+	// been processed, so the dynamic table remains usable.
+	ErrHeaderListSize = errors.New("hpack: header list too large")
+)
+
+// DecodeInteger decodes an integer with an n-bit prefix. It returns the
+// value and the number of octets consumed.
+func DecodeInteger(data []byte, n int) (int, int, error) {
+	if len(data) == 0 {
+		return 0, 0, errTruncated
+	}
 
 	i := (1 << n) - 1
-	v = int(data[0] & byte(i))
+	v := int(data[0] & byte(i))
 	if v < i {
-		return int(v), 1
+		return v, 1, nil
 	}
 
-	v = 0
-	j := 1
-	m := 0
-	for ; data[j]&0x80 == 0x80; j++ {
-		v = v | (int(data[j]&0x7f) << m)
+	var u uint64
+	m := uint(0)
+	for j := 1; j < len(data); j++ {
+		u |= uint64(data[j]&0x7f) << m
+		if data[j]&0x80 == 0 {
+			u += uint64(i)
+			if u > math.MaxInt32 {
+				return 0, 0, errIntegerOverflow
+			}
+			return int(u), j + 1, nil
+		}
 		m += 7
+		if m > 28 {
+			return 0, 0, errIntegerOverflow
+		}
 	}
-	return v | (int(data[j]&0x7f) << m) + i, j
+	return 0, 0, errTruncated
 }
 
 func EncodeHuffmanCode(str string, eos bool) []byte {
@@ -70,80 +96,209 @@ func EncodeHuffmanCode(str string, eos bool) []byte {
 		}
 	}
 
-	result[len(result)-1] = result[len(result)-1]<<(8-s) | byte((1<<(8-s))-1)
+	if s != 0 {
+		result[len(result)-1] = result[len(result)-1]<<(8-s) | byte((1<<(8-s))-1)
+	}
 
 	return result
 }
 
-func DecodeHuffmanCode(data []byte) string {
-	result := []byte{}
+// HuffmanEncodedLength returns the number of octets EncodeHuffmanCode
+// produces for str, without encoding it.
+func HuffmanEncodedLength(str string) int {
+	bits := 0
+	for i := 0; i < len(str); i++ {
+		bits += HuffmanTable[str[i]].BitLength
+	}
+	return (bits + 7) / 8
+}
 
-	var p uint32 = 0
-	s := 0
-	for i := 0; i < len(data); i++ {
-		for j := 0; j < 8; j++ {
-			b := byte((data[i] >> (8 - j - 1)) & 0x01)
-			p = p<<1 | uint32(b)
-			s++
-
-			for j := 0; j < 256; j++ {
-				if HuffmanTable[j].Code == p && HuffmanTable[j].BitLength == s {
-					result = append(result, byte(j))
-					s = 0
-					p = 0
-				}
+// appendStringLiteral appends a string literal, Huffman encoded whenever
+// that is shorter than the raw octets.
+func appendStringLiteral(dst []byte, str string) []byte {
+	return appendPrefixedStringLiteral(dst, 0, 7, str)
+}
+
+// appendPrefixedStringLiteral appends a string literal whose length has an
+// n-bit prefix. The Huffman flag is the bit above the prefix, and flags
+// fills the remaining high bits of the first octet, as QPACK requires.
+func appendPrefixedStringLiteral(dst []byte, flags byte, n int, str string) []byte {
+	if l := HuffmanEncodedLength(str); l < len(str) {
+		d := EncodeInteger(l, n)
+		d[0] |= flags | 1<<n
+		dst = append(dst, d...)
+		return append(dst, EncodeHuffmanCode(str, false)...)
+	}
+
+	d := EncodeInteger(len(str), n)
+	d[0] |= flags
+	dst = append(dst, d...)
+	return append(dst, str...)
+}
+
+// huffmanNode is a node of a 256-ary tree over the Huffman codes. Internal
+// nodes consume 8 bits of input at a time; a leaf holds a symbol and the
+// number of bits its code uses within the last octet consumed.
+type huffmanNode struct {
+	children *[256]*huffmanNode
+	sym      int
+	codeLen  uint8
+}
+
+var huffmanRoot = buildHuffmanTree()
+
+func buildHuffmanTree() *huffmanNode {
+	root := &huffmanNode{children: new([256]*huffmanNode)}
+	for sym, r := range HuffmanTable {
+		code := r.Code
+		length := uint8(r.BitLength)
+
+		cur := root
+		for length > 8 {
+			length -= 8
+			i := uint8(code >> length)
+			if cur.children[i] == nil {
+				cur.children[i] = &huffmanNode{children: new([256]*huffmanNode)}
 			}
+			cur = cur.children[i]
 		}
 
+		shift := 8 - length
+		start, end := int(uint8(code<<shift)), 1<<shift
+		leaf := &huffmanNode{sym: sym, codeLen: length}
+		for i := start; i < start+end; i++ {
+			cur.children[i] = leaf
+		}
 	}
-	return string(result)
+	return root
 }
 
-func EncodeHeaders(hl HeaderList) ([]byte, error) {
-	result := make([]byte, 0)
+var (
+	errHuffmanEOS     = errors.New("EOS symbol in Huffman-encoded string")
+	errHuffmanPadding = errors.New("invalid Huffman padding")
+)
 
-	for i := 0; i < len(hl); i++ {
-		h := hl[i]
-		match := false
-		for j := 1; j < len(StaticTable); j++ {
-			if strings.Compare(h.Name, StaticTable[j].Name) == 0 {
-				if strings.Compare(h.Value, StaticTable[j].Value) == 0 {
-					result = append(result, h.DumpIndexedHeaderField(j)...)
-					match = true
-					break
-				}
+// DecodeHuffmanCode decodes a Huffman-encoded string literal. As required by
+// RFC 7541 5.2, padding longer than 7 bits, padding that is not a prefix of
+// the EOS code, and an explicit EOS symbol are rejected.
+func DecodeHuffmanCode(data []byte) (string, error) {
+	return decodeHuffmanCode(data, 0)
+}
+
+// decodeHuffmanCode stops with errStringLength as soon as the decoded
+// string grows longer than maxLength octets. A maxLength of 0 means no
+// limit.
+func decodeHuffmanCode(data []byte, maxLength int) (string, error) {
+	capacity := len(data) * 8 / 5
+	if maxLength > 0 && capacity > maxLength {
+		capacity = maxLength
+	}
+	result := make([]byte, 0, capacity)
+
+	n := huffmanRoot
+	var cur uint
+	var cbits, sbits uint8
+	for i := 0; i < len(data); i++ {
+		cur = cur<<8 | uint(data[i])
+		cbits += 8
+		sbits += 8
+		for cbits >= 8 {
+			n = n.children[byte(cur>>(cbits-8))]
+			if n.children != nil {
+				cbits -= 8
+				continue
 			}
+			if n.sym == 256 {
+				return "", errHuffmanEOS
+			}
+			if maxLength > 0 && len(result) >= maxLength {
+				return "", errStringLength
+			}
+			result = append(result, byte(n.sym))
+			cbits -= n.codeLen
+			n = huffmanRoot
+			sbits = cbits
 		}
-		if match {
-			continue
+	}
+
+	for cbits > 0 {
+		n = n.children[byte(cur<<(8-cbits))]
+		if n.children != nil || n.codeLen > cbits {
+			break
 		}
-		for j := 1; j < len(StaticTable); j++ {
-			if strings.Compare(h.Name, StaticTable[j].Name) == 0 {
-				d, err := h.DumpLiteralHeaderFieldWithIndexedName(j, IndexingWithout)
-				if err != nil {
-					return nil, err
-				}
-				result = append(result, d...)
-				match = true
-				break
-			}
+		if n.sym == 256 {
+			return "", errHuffmanEOS
 		}
-		if match {
-			continue
+		if maxLength > 0 && len(result) >= maxLength {
+			return "", errStringLength
 		}
+		result = append(result, byte(n.sym))
+		cbits -= n.codeLen
+		n = huffmanRoot
+		sbits = cbits
+	}
 
-		d, err := h.DumpLiteralHeaderFieldWithNewdName(IndexingWithout)
-		if err != nil {
-			return nil, err
-		}
-		result = append(result, d...)
-		match = true
+	if sbits > 7 {
+		return "", errHuffmanPadding
+	}
+	if mask := uint(1<<cbits - 1); cur&mask != mask {
+		return "", errHuffmanPadding
+	}
+	return string(result), nil
+}
+
+// EncodeHeaders encodes a header list using the static table only, so the
+// result does not depend on any connection state.
+func EncodeHeaders(hl HeaderList) ([]byte, error) {
+	e := NewHeaderEncoder()
+	e.Strategy = StaticOnlyStrategy{}
+	return e.Encode(hl)
+}
+
+// DecodingError reports a malformed header block. HTTP/2 treats it as a
+// connection error of type COMPRESSION_ERROR.
+type DecodingError struct {
+	Err error
+}
 
+func (e DecodingError) Error() string {
+	return fmt.Sprintf("hpack: decoding error: %v", e.Err)
+}
+
+func (d *HeaderDecoder) parseStringLiteral(input []byte) (string, bool, int, error) {
+	return parsePrefixedStringLiteral(input, 7, d.MaxStringLength)
+}
+
+// parsePrefixedStringLiteral parses a string literal whose length has an
+// n-bit prefix and whose Huffman flag is the bit above it. A maxLength of
+// 0 means no limit.
+func parsePrefixedStringLiteral(input []byte, n int, maxLength int) (string, bool, int, error) {
+	length, i, err := DecodeInteger(input, n)
+	if err != nil {
+		return "", false, 0, err
 	}
-	return result, nil
+	huffman := input[0]&(1<<n) != 0
+	// Checked before waiting for the rest of the string, so that a
+	// streaming decoder never buffers an oversized literal. Huffman codes
+	// are at most 30 bits long.
+	if maxLength > 0 && (!huffman && length > maxLength || huffman && length/30*8 > maxLength) {
+		return "", false, 0, errStringLength
+	}
+	if len(input)-i < length {
+		return "", false, 0, errTruncated
+	}
+	if !huffman {
+		return string(input[i : i+length]), false, i + length, nil
+	}
+
+	str, err := decodeHuffmanCode(input[i:i+length], maxLength)
+	if err != nil {
+		return "", true, 0, err
+	}
+	return str, true, i + length, nil
 }
 
-func (d *HeaderDecoder) parseIndexedName(index int, input []byte, indexingType indexingType) (HeaderFieldFormat, int) {
+func (d *HeaderDecoder) parseIndexedName(index int, input []byte, indexingType indexingType) (HeaderFieldFormat, int, error) {
 	var result HeaderFieldFormat
 	result.representationType = LiteralHeaderField
 	result.indexingType = indexingType
@@ -152,153 +307,207 @@ func (d *HeaderDecoder) parseIndexedName(index int, input []byte, indexingType i
 
 	field := d.getTableValue(index)
 	if field == nil {
-		log.Fatal("Header table error")
+		return result, 0, errInvalidIndex
 	}
 
 	result.Name = (*field).Name
 
-	i := 0
-	valueLength, j := DecodeInteger(input[i:], 7)
-
-	result.hValue = input[i]&0x80 == 0x80
-	i += j
-	if result.hValue {
-		result.Value = DecodeHuffmanCode(input[i : i+valueLength])
-	} else {
-		result.Value = string(input[i : i+valueLength])
+	var i int
+	var err error
+	result.Value, result.hValue, i, err = d.parseStringLiteral(input)
+	if err != nil {
+		return result, 0, err
 	}
-	i += valueLength
-	return result, i
+	return result, i, nil
 }
 
-func (d *HeaderDecoder) parseNewName(input []byte, indexingType indexingType) (HeaderFieldFormat, int) {
+func (d *HeaderDecoder) parseNewName(input []byte, indexingType indexingType) (HeaderFieldFormat, int, error) {
 	var result HeaderFieldFormat
 	result.representationType = LiteralHeaderField
 	result.indexingType = indexingType
 
-	i := 0
-	nameLength, j := DecodeInteger(input[i:], 7)
-	result.hName = input[i]&0x80 == 0x80
-	i += j
-	if result.hName {
-		result.Name = DecodeHuffmanCode(input[i : i+nameLength])
-	} else {
-		result.Name = string(input[i : i+nameLength])
+	var i, j int
+	var err error
+	result.Name, result.hName, i, err = d.parseStringLiteral(input)
+	if err != nil {
+		return result, 0, err
 	}
-	i += nameLength
-
-	valueLength, j := DecodeInteger(input[i:], 7)
 
-	result.hValue = input[i]&0x80 == 0x80
-	i += j
-	if result.hValue {
-		result.Value = DecodeHuffmanCode(input[i : i+valueLength])
-	} else {
-		result.Value = string(input[i : i+valueLength])
+	result.Value, result.hValue, j, err = d.parseStringLiteral(input[i:])
+	if err != nil {
+		return result, 0, err
 	}
-	i += valueLength
+	i += j
 
-	return result, i
+	return result, i, nil
 }
 
-func (d *HeaderDecoder) parseHeaderBlockFragment(input []byte) []HeaderFieldFormat {
-	var result []HeaderFieldFormat
+// parseField parses the representation at the start of input. It returns
+// errTruncated, without touching the dynamic table, if input ends before
+// the representation does.
+func (d *HeaderDecoder) parseField(input []byte) (HeaderFieldFormat, int, error) {
+	var f HeaderFieldFormat
+	b := input[0]
+
+	if b&0xe0 == 0x20 {
+		if d.fieldSeen {
+			// Dynamic Table Size Update must come first in a header block.
+			return f, 0, errTableSizeUpdate
+		}
+	} else if d.sizeUpdateRequired {
+		return f, 0, errTableSizeUpdate
+	}
+
+	var i int
+	var err error
+	switch {
+	case b&0x80 == 0x80:
+		// Indexed Header Field
+		var index int
+		index, i, err = DecodeInteger(input, 7)
+		if err != nil {
+			return f, 0, err
+		}
+
+		field := d.getTableValue(index)
+		if field == nil {
+			return f, 0, errInvalidIndex
+		}
+
+		f = HeaderFieldFormat{
+			representationType: IndexHeaderField,
+			tableIndex:         index,
+			HeaderField:        *field,
+		}
+	case b&0xc0 == 0x40:
+		// Literal Header Field with Incremental Indexing
+		f, i, err = d.parseLiteral(input, 6, IndexingIncremental)
+		if err != nil {
+			return f, 0, err
+		}
+		d.insertIntoDynamicTable(HeaderField{f.Name, f.Value})
+	case b&0xf0 == 0x00:
+		// Literal Header Field without Indexing
+		f, i, err = d.parseLiteral(input, 4, IndexingWithout)
+		if err != nil {
+			return f, 0, err
+		}
+	case b&0xf0 == 0x10:
+		// Literal Header Field Never Indexed
+		f, i, err = d.parseLiteral(input, 4, IndexingNever)
+		if err != nil {
+			return f, 0, err
+		}
+	case b&0xe0 == 0x20:
+		// Maximum Dynamic Table Size Change
+		var max int
+		max, i, err = DecodeInteger(input, 5)
+		if err != nil {
+			return f, 0, err
+		}
+		if max > d.MaxSizeLimit {
+			return f, 0, errTableSizeUpdate
+		}
+		f = HeaderFieldFormat{
+			representationType: DynamicTableSizeUpdate,
+			MaxSize:            max,
+		}
+		d.MaxSize = max
+		d.evictEntry()
+		d.sizeUpdateRequired = false
+		return f, i, nil
+	default:
+		return f, 0, errInvalidIndex
+	}
 
-	for i := 0; i < len(input); {
+	d.fieldSeen = true
+	return f, i, nil
+}
 
-		b := input[i]
+func (d *HeaderDecoder) parseLiteral(input []byte, n int, indexingType indexingType) (HeaderFieldFormat, int, error) {
+	if input[0]&(1<<n-1) == 0 {
+		// New Name
+		f, j, err := d.parseNewName(input[1:], indexingType)
+		return f, j + 1, err
+	}
 
-		switch {
-		case b&0x80 == 0x80:
-			// Indexed Header Field
-			index, j := DecodeInteger(input[i:], 7)
+	// Indexed Name
+	index, k, err := DecodeInteger(input, n)
+	if err != nil {
+		return HeaderFieldFormat{}, 0, err
+	}
+	f, j, err := d.parseIndexedName(index, input[k:], indexingType)
+	return f, k + j, err
+}
 
-			field := d.getTableValue(index)
-			if field == nil {
-				log.Fatal("Header table error")
-			}
+// SetEmitFunc sets the function Write calls for each decoded header field.
+// Dynamic Table Size Updates are not reported.
+func (d *HeaderDecoder) SetEmitFunc(emit func(f HeaderFieldFormat)) {
+	d.emit = emit
+}
 
-			f := HeaderFieldFormat{
-				representationType: IndexHeaderField,
-				tableIndex:         index,
-				HeaderField:        *field,
-			}
+// Write decodes the next fragment of the current header block, e.g. the
+// payload of a HEADERS or CONTINUATION frame. Each header field is passed
+// to the emit function as soon as it is complete; a representation split
+// across fragments is carried over to the next call. Close ends the block.
+//
+// Once the header list exceeds MaxHeaderListSize, fields are still decoded
+// to keep the dynamic table in sync but no longer emitted, and Close
+// reports ErrHeaderListSize.
+func (d *HeaderDecoder) Write(p []byte) (int, error) {
+	input := p
+	if len(d.pending) > 0 {
+		d.pending = append(d.pending, p...)
+		input = d.pending
+	}
 
-			result = append(result, f)
-			i += j
-			break
-		case b&0xc0 == 0x40:
-			// Literal Header Field with Incremental Indexing
-			if b == 0x40 {
-				// New Name
-				i++
-				f, j := d.parseNewName(input[i:], IndexingIncremental)
-				result = append(result, f)
-				d.insertIntoDynamicTable(HeaderField{f.Name, f.Value})
-				i += j
-			} else {
-				// Indexed Name
-				index, k := DecodeInteger(input[i:], 6)
-				i += k
-				f, j := d.parseIndexedName(index, input[i:], IndexingIncremental)
-				result = append(result, f)
-				d.insertIntoDynamicTable(HeaderField{f.Name, f.Value})
-				i += j
-			}
-			break
-		case b&0xf0 == 0x00:
-			// Literal Header Field without Indexing
-			if b == 0x00 {
-				// New Name
-				i++
-				f, j := d.parseNewName(input[i:], IndexingWithout)
-				result = append(result, f)
-				i += j
-			} else {
-				// Indexed Name
-				index, k := DecodeInteger(input[i:], 4)
-				i += k
-				f, j := d.parseIndexedName(index, input[i:], IndexingWithout)
-				result = append(result, f)
-				i += j
-			}
-			break
-		case b&0xf0 == 0x10:
-			// Literal Header Field Never Indexed
-			if b == 0x10 {
-				// New Name
-				i++
-				f, j := d.parseNewName(input[i:], IndexingNever)
-				result = append(result, f)
-				i += j
-			} else {
-				// Indexed Name
-				index, k := DecodeInteger(input[i:], 4)
-				i += k
-				f, j := d.parseIndexedName(index, input[i:], IndexingNever)
-				result = append(result, f)
-				i += j
-			}
-			break
-		case b&0xe0 == 0x20:
-			// Maximum Dynamic Table Size Change
-			max, k := DecodeInteger(input[i:], 5)
-			i += k
-			f := HeaderFieldFormat{
-				representationType: DynamicTableSizeUpdate,
-				MaxSize:            max,
-			}
-			result = append(result, f)
-			d.MaxSize = max
-			d.evictEntry()
-			break
-		default:
-			// TODO: parse error
+	for len(input) > 0 {
+		f, n, err := d.parseField(input)
+		if err == errTruncated {
 			break
+		} else if err != nil {
+			d.reset()
+			return 0, DecodingError{err}
 		}
+		input = input[n:]
 
+		if f.representationType == DynamicTableSizeUpdate {
+			continue
+		}
+		d.listSize += f.Size()
+		if d.MaxHeaderListSize > 0 && d.listSize > d.MaxHeaderListSize {
+			d.tooLarge = true
+		}
+		if !d.tooLarge && d.emit != nil {
+			d.emit(f)
+		}
 	}
-	return result
+
+	d.pending = append(d.pending[:0], input...)
+	return len(p), nil
+}
+
+// Close ends the current header block. It fails if the block ended in the
+// middle of a representation or the header list grew too large.
+func (d *HeaderDecoder) Close() error {
+	truncated := len(d.pending) > 0
+	tooLarge := d.tooLarge
+	d.reset()
+
+	if truncated {
+		return DecodingError{errTruncated}
+	}
+	if tooLarge {
+		return ErrHeaderListSize
+	}
+	return nil
+}
+
+func (d *HeaderDecoder) reset() {
+	d.pending = d.pending[:0]
+	d.fieldSeen = false
+	d.listSize = 0
+	d.tooLarge = false
 }
 
 type HeaderField struct {
@@ -306,6 +515,11 @@ type HeaderField struct {
 	Value string
 }
 
+// Size returns the size of the field as an entry of the dynamic table.
+func (h *HeaderField) Size() int {
+	return len(h.Name) + len(h.Value) + 32
+}
+
 func (h *HeaderField) DumpIndexedHeaderField(index int) []byte {
 	d := EncodeInteger(index, 7)
 	d[0] |= 0x80
@@ -326,6 +540,12 @@ type HeaderFieldFormat struct {
 	MaxSize int
 }
 
+// NeverIndexed reports whether the field was sent as a never-indexed
+// literal. An intermediary must forward such a field the same way.
+func (f *HeaderFieldFormat) NeverIndexed() bool {
+	return f.representationType == LiteralHeaderField && f.indexingType == IndexingNever
+}
+
 const (
 	IndexHeaderField representationType = iota
 	LiteralHeaderField
@@ -357,9 +577,7 @@ func (h *HeaderField) DumpLiteralHeaderFieldWithIndexedName(index int, indexingT
 		return nil, errIllegalArgument
 	}
 
-	d := EncodeInteger(len(h.Value), 7)
-	result = append(result, d...)
-	result = append(result, h.Value...)
+	result = appendStringLiteral(result, h.Value)
 
 	return result, nil
 }
@@ -382,67 +600,364 @@ func (h *HeaderField) DumpLiteralHeaderFieldWithNewdName(indexingType indexingTy
 		return nil, errIllegalArgument
 	}
 
-	result = append(result, EncodeInteger(len(h.Name), 7)...)
-	result = append(result, h.Name...)
-
-	result = append(result, EncodeInteger(len(h.Value), 7)...)
-	result = append(result, h.Value...)
+	result = appendStringLiteral(result, h.Name)
+	result = appendStringLiteral(result, h.Value)
 
 	return result, nil
 }
 
+// HeaderTable is the HPACK index address space: the static table followed
+// by a dynamic table. The dynamic table is a ring buffer that keeps a
+// running total of its size, and both tables are indexed by name and by
+// name and value so that an encoder can look fields up in constant time.
+type HeaderTable struct {
+	MaxSize int
+
+	entries []HeaderField
+	start   int
+	count   int
+	size    int
+
+	// Every inserted entry gets a sequential ID; the newest entry has ID
+	// nextID-1 and the oldest nextID-count. The maps point to the newest
+	// entry carrying a name or a name and value pair.
+	nextID      uint64
+	byName      map[string]uint64
+	byNameValue map[HeaderField]uint64
+}
+
+func newHeaderTable(maxSize int) HeaderTable {
+	return HeaderTable{
+		MaxSize:     maxSize,
+		byName:      make(map[string]uint64),
+		byNameValue: make(map[HeaderField]uint64),
+	}
+}
+
 type HeaderDecoder struct {
-	DynamicTable []HeaderField
-	MaxSize      int
+	HeaderTable
+
+	// MaxSizeLimit is the SETTINGS_HEADER_TABLE_SIZE we advertised. A
+	// Dynamic Table Size Update may not exceed it.
+	MaxSizeLimit int
+
+	// MaxStringLength caps every decoded name and value, after Huffman
+	// decoding. 0 means no limit.
+	MaxStringLength int
+
+	// MaxHeaderListSize caps the decoded header list as computed for
+	// SETTINGS_MAX_HEADER_LIST_SIZE. 0 means no limit.
+	MaxHeaderListSize int
+
+	sizeUpdateRequired bool
+
+	// State of the header block being decoded by Write.
+	emit      func(f HeaderFieldFormat)
+	pending   []byte
+	fieldSeen bool
+	listSize  int
+	tooLarge  bool
 }
 
-func (d *HeaderDecoder) Decode(input []byte) map[string][]string {
-	hl := d.parseHeaderBlockFragment(input)
-	fmt.Printf("Headers: %#v\n", hl)
+// SetMaxDynamicTableSizeLimit applies a new SETTINGS_HEADER_TABLE_SIZE once
+// the peer has acknowledged it. If the current table is larger than the new
+// limit, the next header block must start with a Dynamic Table Size Update.
+func (d *HeaderDecoder) SetMaxDynamicTableSizeLimit(limit int) {
+	d.MaxSizeLimit = limit
+	if d.MaxSize > limit {
+		d.sizeUpdateRequired = true
+	}
+}
 
-	headers := make(map[string][]string)
+func NewHeaderDecoder() *HeaderDecoder {
+	return &HeaderDecoder{
+		HeaderTable:  newHeaderTable(4096),
+		MaxSizeLimit: 4096,
+	}
+}
+
+func (d *HeaderDecoder) Decode(input []byte) ([]HeaderField, error) {
+	hl, err := d.DecodeFormats(input)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make([]HeaderField, 0, len(hl))
 	for i := 0; i < len(hl); i++ {
-		if hl[i].representationType != DynamicTableSizeUpdate {
-			if v, ok := headers[hl[i].Name]; ok {
-				headers[hl[i].Name] = append(v, hl[i].Value)
-			} else {
-				headers[hl[i].Name] = []string{hl[i].Value}
-			}
-		}
+		headers = append(headers, hl[i].HeaderField)
+	}
+
+	return headers, nil
+}
+
+// DecodeFormats decodes a header block like Decode, but also reports how
+// each field was represented, e.g. whether it arrived never-indexed.
+// Dynamic Table Size Updates are not included.
+func (d *HeaderDecoder) DecodeFormats(input []byte) ([]HeaderFieldFormat, error) {
+	var fields []HeaderFieldFormat
+	emit := d.emit
+	d.SetEmitFunc(func(f HeaderFieldFormat) {
+		fields = append(fields, f)
+	})
+	defer d.SetEmitFunc(emit)
+
+	if _, err := d.Write(input); err != nil {
+		return nil, err
+	}
+	if err := d.Close(); err != nil {
+		return nil, err
 	}
+	fmt.Printf("Headers: %#v\n", fields)
 
-	return headers
+	return fields, nil
 }
 
-func (d *HeaderDecoder) getTableValue(index int) *HeaderField {
-	if index < len(StaticTable) {
+func (t *HeaderTable) getTableValue(index int) *HeaderField {
+	if index <= 0 {
+		return nil
+	} else if index < len(StaticTable) {
 		return &StaticTable[index]
-	} else if index-len(StaticTable) < len(d.DynamicTable) {
-		return &d.DynamicTable[index-len(StaticTable)]
+	} else if index-len(StaticTable) < t.count {
+		return t.dynamicEntry(index - len(StaticTable))
 	}
 	return nil
 }
 
-func (d *HeaderDecoder) insertIntoDynamicTable(field HeaderField) {
-	d.DynamicTable = append(
-		[]HeaderField{field},
-		d.DynamicTable...)
+// dynamicEntry returns the i-th entry of the dynamic table, where 0 is the
+// most recently inserted one.
+func (t *HeaderTable) dynamicEntry(i int) *HeaderField {
+	return &t.entries[(t.start+t.count-1-i)%len(t.entries)]
+}
 
-	d.evictEntry()
+// Entries returns a copy of the dynamic table, newest entry first.
+func (t *HeaderTable) Entries() []HeaderField {
+	result := make([]HeaderField, t.count)
+	for i := 0; i < t.count; i++ {
+		result[i] = *t.dynamicEntry(i)
+	}
+	return result
 }
 
-func (d *HeaderDecoder) evictEntry() {
-	for d.MaxSize < d.getDynamicTableSize() && len(d.DynamicTable) != 0 {
-		d.DynamicTable = d.DynamicTable[0 : len(d.DynamicTable)-1]
+func (t *HeaderTable) insertIntoDynamicTable(field HeaderField) {
+	if t.byName == nil {
+		t.byName = make(map[string]uint64)
+		t.byNameValue = make(map[HeaderField]uint64)
 	}
+
+	if t.count == len(t.entries) {
+		entries := make([]HeaderField, 2*len(t.entries)+8)
+		for i := 0; i < t.count; i++ {
+			entries[i] = t.entries[(t.start+i)%len(t.entries)]
+		}
+		t.entries = entries
+		t.start = 0
+	}
+	t.entries[(t.start+t.count)%len(t.entries)] = field
+	t.count++
+	t.size += field.Size()
+
+	t.byName[field.Name] = t.nextID
+	t.byNameValue[field] = t.nextID
+	t.nextID++
+
+	t.evictEntry()
 }
 
-func (d *HeaderDecoder) getDynamicTableSize() int {
-	size := 0
-	for i := 0; i < len(d.DynamicTable); i++ {
-		size += len(d.DynamicTable[i].Name) + len(d.DynamicTable[i].Value) + 32
+func (t *HeaderTable) evictEntry() {
+	for t.MaxSize < t.size && t.count != 0 {
+		field := t.entries[t.start]
+		id := t.nextID - uint64(t.count)
+		if t.byName[field.Name] == id {
+			delete(t.byName, field.Name)
+		}
+		if t.byNameValue[field] == id {
+			delete(t.byNameValue, field)
+		}
+
+		t.entries[t.start] = HeaderField{}
+		t.start = (t.start + 1) % len(t.entries)
+		t.count--
+		t.size -= field.Size()
 	}
-	return size
+}
+
+func (t *HeaderTable) getDynamicTableSize() int {
+	return t.size
+}
+
+var (
+	staticByName      = make(map[string]int)
+	staticByNameValue = make(map[HeaderField]int)
+)
+
+func init() {
+	for i := len(StaticTable) - 1; i > 0; i-- {
+		staticByName[StaticTable[i].Name] = i
+		staticByNameValue[StaticTable[i]] = i
+	}
+}
+
+// search looks a field up in the static and dynamic tables. It returns the
+// index of an entry matching both name and value, or failing that the index
+// of an entry matching the name only. The index is 0 when nothing matches.
+func (t *HeaderTable) search(field HeaderField) (index int, nameValueMatch bool) {
+	if i, ok := staticByNameValue[field]; ok {
+		return i, true
+	}
+	if id, ok := t.byNameValue[field]; ok {
+		return len(StaticTable) + int(t.nextID-1-id), true
+	}
+	if i, ok := staticByName[field.Name]; ok {
+		return i, false
+	}
+	if id, ok := t.byName[field.Name]; ok {
+		return len(StaticTable) + int(t.nextID-1-id), false
+	}
+	return 0, false
+}
+
+// maxEncoderTableSize caps the dynamic table of a HeaderEncoder no matter
+// how large a table the peer allows.
+const maxEncoderTableSize = 4096
+
+// HeaderEncoder is the encoding side of a connection's HPACK context. It
+// keeps a dynamic table mirroring the one of the peer's decoder and adds
+// fields to it with incremental indexing.
+type HeaderEncoder struct {
+	HeaderTable
+	minSize           int
+	pendingSizeUpdate bool
+
+	// SensitiveHeaders lists further header names that are always sent as
+	// never-indexed literals, in addition to authorization,
+	// proxy-authorization and short cookies.
+	SensitiveHeaders []string
+
+	// Strategy decides how fields are represented. IndexAllStrategy is used
+	// when it is nil.
+	Strategy IndexingStrategy
+}
+
+// minIndexedCookieLength is the length below which a cookie value is
+// considered guessable enough to be protected from compression-based
+// attacks such as CRIME.
+const minIndexedCookieLength = 20
+
+func (e *HeaderEncoder) isSensitive(h HeaderField) bool {
+	return isSensitiveHeader(h, e.SensitiveHeaders)
+}
+
+// isSensitiveHeader reports whether a field must never be added to a
+// compression table: credentials, short cookies and the names in extra.
+// Each cookie crumb is judged on its own, as nghttp2 does.
+func isSensitiveHeader(h HeaderField, extra []string) bool {
+	switch h.Name {
+	case "authorization", "proxy-authorization":
+		return true
+	case "cookie":
+		if len(h.Value) < minIndexedCookieLength {
+			return true
+		}
+	}
+	for _, name := range extra {
+		if strings.EqualFold(h.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func NewHeaderEncoder() *HeaderEncoder {
+	return &HeaderEncoder{
+		HeaderTable: newHeaderTable(4096),
+	}
+}
+
+// SetMaxDynamicTableSizeLimit applies the peer's SETTINGS_HEADER_TABLE_SIZE.
+// A Dynamic Table Size Update is emitted at the start of the next header
+// block whenever the table size changes.
+func (e *HeaderEncoder) SetMaxDynamicTableSizeLimit(limit int) {
+	size := limit
+	if size > maxEncoderTableSize {
+		size = maxEncoderTableSize
+	}
+	if size == e.MaxSize {
+		return
+	}
+
+	if !e.pendingSizeUpdate || size < e.minSize {
+		e.minSize = size
+	}
+	e.pendingSizeUpdate = true
+	e.MaxSize = size
+	e.evictEntry()
+}
+
+func (e *HeaderEncoder) Encode(hl HeaderList) ([]byte, error) {
+	result := make([]byte, 0)
+
+	if e.pendingSizeUpdate {
+		// The table may have shrunk below its final size in between
+		// two header blocks; RFC 7541 4.2 requires signalling the
+		// smallest size first.
+		if e.minSize < e.MaxSize {
+			result = append(result, DumpDynamicTableSizeUpdate(e.minSize)...)
+		}
+		result = append(result, DumpDynamicTableSizeUpdate(e.MaxSize)...)
+		e.pendingSizeUpdate = false
+	}
+
+	strategy := e.Strategy
+	if strategy == nil {
+		strategy = IndexAllStrategy{}
+	}
+
+	for i := 0; i < len(hl); i++ {
+		h := hl[i]
+		index, nameValueMatch := e.search(h)
+
+		var representation representationType
+		var indexing indexingType
+		if e.isSensitive(h) {
+			representation, indexing = LiteralHeaderField, IndexingNever
+		} else {
+			representation, indexing = strategy.Choose(h, index, nameValueMatch, &e.HeaderTable)
+		}
+
+		if representation == IndexHeaderField {
+			if nameValueMatch {
+				result = append(result, h.DumpIndexedHeaderField(index)...)
+				continue
+			}
+			indexing = IndexingWithout
+		}
+		if indexing == IndexingIncremental && h.Size() > e.MaxSize {
+			indexing = IndexingWithout
+		}
+
+		var d []byte
+		var err error
+		if index != 0 {
+			d, err = h.DumpLiteralHeaderFieldWithIndexedName(index, indexing)
+		} else {
+			d, err = h.DumpLiteralHeaderFieldWithNewdName(indexing)
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, d...)
+
+		if indexing == IndexingIncremental {
+			e.insertIntoDynamicTable(h)
+		}
+	}
+	return result, nil
+}
+
+func DumpDynamicTableSizeUpdate(size int) []byte {
+	d := EncodeInteger(size, 5)
+	d[0] |= 0x20
+	return d
 }
 
 type HeaderList []HeaderField
@@ -464,7 +979,7 @@ var StaticTable []HeaderField = []HeaderField{
 	{":status", "400"},
 	{":status", "404"},
 	{":status", "500"},
-	{":accept-charset", ""},
+	{"accept-charset", ""},
 	{"accept-encoding", "gzip, deflate"},
 	{"accept-language", ""},
 	{"accept-ranges", ""},
@@ -494,7 +1009,7 @@ var StaticTable []HeaderField = []HeaderField{
 
 	{"if-modified-since", ""},
 	{"if-none-match", ""},
-	{"if-range ", ""},
+	{"if-range", ""},
 	{"if-unmodified-since", ""},
 	{"last-modified", ""},
 	{"link", ""},
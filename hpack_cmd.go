@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const hpackUsage = `usage: http2client hpack decode [-binary] [-table-size n] [file ...]
+       http2client hpack encode [-strategy all|static|frequency] [-table-size n] [file ...]
+
+decode reads HPACK header blocks as hex, one block per paragraph, and
+prints how each representation is decoded in the style of RFC 7541
+Appendix C. Whitespace, "#" comments and anything after "|" are ignored,
+so the appendix dumps can be pasted as they are. With -binary the whole
+input is a single raw header block.
+
+encode reads header lists as "name: value" lines, one list per
+paragraph, and prints the encoded blocks followed by their decoding.
+`
+
+// hpackCommand implements the hpack subcommand.
+func hpackCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(hpackUsage)
+	}
+
+	fs := flag.NewFlagSet("hpack "+args[0], flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), hpackUsage)
+	}
+	tableSize := fs.Int("table-size", 4096, "initial dynamic table size")
+	binary := fs.Bool("binary", false, "read a single raw header block")
+	strategy := fs.String("strategy", "all", "encoder indexing strategy")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	input, err := readHPACKInput(fs.Args(), stdin)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "decode":
+		var blocks [][]byte
+		if *binary {
+			blocks = [][]byte{input}
+		} else if blocks, err = parseHexBlocks(input); err != nil {
+			return err
+		}
+
+		d := NewHeaderDecoder()
+		d.MaxSizeLimit = *tableSize
+		d.MaxSize = *tableSize
+		for i, block := range blocks {
+			fmt.Fprintf(stdout, "# Header block %d\n\n", i+1)
+			if err := dumpHeaderBlock(stdout, d, block); err != nil {
+				return fmt.Errorf("header block %d: %v", i+1, err)
+			}
+			dumpDynamicTable(stdout, &d.HeaderTable, "decoding")
+		}
+		return nil
+	case "encode":
+		e := NewHeaderEncoder()
+		e.MaxSize = *tableSize
+		switch *strategy {
+		case "all":
+		case "static":
+			e.Strategy = StaticOnlyStrategy{}
+		case "frequency":
+			e.Strategy = NewFrequencyStrategy()
+		default:
+			return fmt.Errorf("unknown strategy %q", *strategy)
+		}
+
+		lists, err := parseHeaderLists(input)
+		if err != nil {
+			return err
+		}
+
+		d := NewHeaderDecoder()
+		d.MaxSizeLimit = *tableSize
+		d.MaxSize = *tableSize
+		for i, hl := range lists {
+			block, err := e.Encode(hl)
+			if err != nil {
+				return fmt.Errorf("header list %d: %v", i+1, err)
+			}
+			fmt.Fprintf(stdout, "# Header block %d\n\n", i+1)
+			writeHexColumn(stdout, block, nil)
+			fmt.Fprintln(stdout)
+			if err := dumpHeaderBlock(stdout, d, block); err != nil {
+				return fmt.Errorf("header block %d: %v", i+1, err)
+			}
+			dumpDynamicTable(stdout, &e.HeaderTable, "encoding")
+		}
+		return nil
+	default:
+		return errors.New(hpackUsage)
+	}
+}
+
+func readHPACKInput(files []string, stdin io.Reader) ([]byte, error) {
+	if len(files) == 0 {
+		return ioutil.ReadAll(stdin)
+	}
+
+	var result []byte
+	for _, name := range files {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, data...)
+		result = append(result, '\n', '\n')
+	}
+	return result, nil
+}
+
+// parseHexBlocks splits hex input into header blocks at blank lines.
+func parseHexBlocks(input []byte) ([][]byte, error) {
+	var blocks [][]byte
+	var digits strings.Builder
+
+	flush := func() error {
+		if digits.Len() == 0 {
+			return nil
+		}
+		block, err := hex.DecodeString(digits.String())
+		if err != nil {
+			return fmt.Errorf("header block %d: %v", len(blocks)+1, err)
+		}
+		blocks = append(blocks, block)
+		digits.Reset()
+		return nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(input))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#|"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.Join(strings.Fields(line), "")
+		if line == "" {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		digits.WriteString(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// parseHeaderLists reads "name: value" lines, splitting header lists at
+// blank lines.
+func parseHeaderLists(input []byte) ([]HeaderList, error) {
+	var lists []HeaderList
+	var hl HeaderList
+
+	scanner := bufio.NewScanner(bytes.NewReader(input))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "" {
+			if len(hl) > 0 {
+				lists = append(lists, hl)
+				hl = nil
+			}
+			continue
+		}
+
+		// Skip the leading colon of pseudo-header fields.
+		i := strings.Index(line[1:], ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid header line %q", line)
+		}
+		hl = append(hl, HeaderField{line[:i+1], strings.TrimSpace(line[i+2:])})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(hl) > 0 {
+		lists = append(lists, hl)
+	}
+	return lists, nil
+}
+
+// dumpHeaderBlock decodes block with d, printing each representation next
+// to the octets it was decoded from.
+func dumpHeaderBlock(w io.Writer, d *HeaderDecoder, block []byte) error {
+	d.reset()
+	defer d.reset()
+
+	for i := 0; i < len(block); {
+		f, n, err := d.parseField(block[i:])
+		if err != nil {
+			writeHexColumn(w, block[i:], []string{"== Error ==", "  " + err.Error()})
+			return DecodingError{err}
+		}
+		writeHexColumn(w, block[i:i+n], describeHeaderFieldFormat(f))
+		i += n
+	}
+	fmt.Fprintln(w)
+	return nil
+}
+
+func describeHeaderFieldFormat(f HeaderFieldFormat) []string {
+	if f.representationType == DynamicTableSizeUpdate {
+		return []string{
+			"== Dynamic Table Size Update ==",
+			fmt.Sprintf("  new maximum size = %d", f.MaxSize),
+		}
+	}
+
+	result := []string{fmt.Sprintf("-> %s: %s", f.Name, f.Value)}
+	if f.representationType == IndexHeaderField {
+		return append([]string{
+			"== Indexed - Add ==",
+			fmt.Sprintf("  idx = %d", f.tableIndex),
+		}, result...)
+	}
+
+	var lines []string
+	switch f.indexingType {
+	case IndexingIncremental:
+		lines = append(lines, "== Literal indexed ==")
+	case IndexingWithout:
+		lines = append(lines, "== Literal not indexed ==")
+	case IndexingNever:
+		lines = append(lines, "== Literal never indexed ==")
+	}
+
+	if f.tableIndex > 0 {
+		lines = append(lines, fmt.Sprintf("  Indexed name (idx = %d)", f.tableIndex))
+	} else {
+		lines = append(lines, "  Literal name"+huffmanNote(f.hName))
+	}
+	lines = append(lines, "    "+f.Name)
+	lines = append(lines, "  Literal value"+huffmanNote(f.hValue))
+	lines = append(lines, "    "+f.Value)
+	return append(lines, result...)
+}
+
+func huffmanNote(huffman bool) string {
+	if huffman {
+		return " (Huffman encoded)"
+	}
+	return ""
+}
+
+// writeHexColumn prints data as groups of four hex digits, 16 octets per
+// line, with text in a column on the right.
+func writeHexColumn(w io.Writer, data []byte, text []string) {
+	for i := 0; i*16 < len(data) || i < len(text); i++ {
+		var left []string
+		for j := i * 16; j < len(data) && j < i*16+16; j += 2 {
+			end := j + 2
+			if end > len(data) {
+				end = len(data)
+			}
+			left = append(left, hex.EncodeToString(data[j:end]))
+		}
+
+		if i < len(text) {
+			fmt.Fprintf(w, "%-40s| %s\n", strings.Join(left, " "), text[i])
+		} else {
+			fmt.Fprintln(w, strings.Join(left, " "))
+		}
+	}
+}
+
+func dumpDynamicTable(w io.Writer, t *HeaderTable, after string) {
+	fmt.Fprintf(w, "Dynamic Table (after %s):\n\n", after)
+	entries := t.Entries()
+	if len(entries) == 0 {
+		fmt.Fprintln(w, "  empty.")
+	}
+	for i, e := range entries {
+		fmt.Fprintf(w, "[%3d] (s = %3d) %s: %s\n", i+1, e.Size(), e.Name, e.Value)
+	}
+	fmt.Fprintf(w, "      Table size: %3d\n\n", t.getDynamicTableSize())
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHPACKCommandDecode(t *testing.T) {
+	// RFC 7541 C.4.1, pasted with its ASCII column.
+	input := "8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 | ..A......:k....\nff                                      | .\n"
+
+	var out bytes.Buffer
+	err := hpackCommand([]string{"decode"}, strings.NewReader(input), &out)
+	assert.Nil(t, err)
+
+	expected := `# Header block 1
+
+82                                      | == Indexed - Add ==
+                                        |   idx = 2
+                                        | -> :method: GET
+86                                      | == Indexed - Add ==
+                                        |   idx = 6
+                                        | -> :scheme: http
+84                                      | == Indexed - Add ==
+                                        |   idx = 4
+                                        | -> :path: /
+418c f1e3 c2e5 f23a 6ba0 ab90 f4ff      | == Literal indexed ==
+                                        |   Indexed name (idx = 1)
+                                        |     :authority
+                                        |   Literal value (Huffman encoded)
+                                        |     www.example.com
+                                        | -> :authority: www.example.com
+
+Dynamic Table (after decoding):
+
+[  1] (s =  57) :authority: www.example.com
+      Table size:  57
+
+`
+	assert.Equal(t, expected, out.String())
+
+	out.Reset()
+	err = hpackCommand([]string{"decode", "-binary"}, strings.NewReader("\xbe"), &out)
+	assert.NotNil(t, err)
+	assert.Contains(t, out.String(), "== Error ==")
+}
+
+func TestHPACKCommandEncode(t *testing.T) {
+	input := ":method: GET\n:path: /\nx-custom: value\n\n:method: GET\n:path: /\nx-custom: value\n"
+
+	var out bytes.Buffer
+	err := hpackCommand([]string{"encode", "-table-size", "256"}, strings.NewReader(input), &out)
+	assert.Nil(t, err)
+	assert.Contains(t, out.String(), "| -> x-custom: value")
+	assert.Contains(t, out.String(), "[  1] (s =  45) x-custom: value")
+	// The second block refers to the entry added by the first one.
+	assert.Contains(t, out.String(), "8284 be\n")
+
+	err = hpackCommand([]string{"encode", "-strategy", "unknown"}, strings.NewReader(input), &out)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,136 @@
+package main
+
+// IndexingStrategy decides, for each field a HeaderEncoder encodes, between
+// an indexed representation and a literal with incremental indexing,
+// without indexing or never indexed. index is the table index found for
+// the field, or 0 when neither its name nor its value are in the table;
+// nameValueMatch reports whether index matches the value too.
+//
+// Sensitive fields are always encoded as never-indexed literals and never
+// reach the strategy. Choosing IndexHeaderField without an exact match
+// falls back to a literal without indexing.
+type IndexingStrategy interface {
+	Choose(field HeaderField, index int, nameValueMatch bool, table *HeaderTable) (representationType, indexingType)
+}
+
+// StaticOnlyStrategy never touches the dynamic table: it refers to exact
+// static table matches and sends everything else without indexing.
+type StaticOnlyStrategy struct{}
+
+func (s StaticOnlyStrategy) Choose(field HeaderField, index int, nameValueMatch bool, table *HeaderTable) (representationType, indexingType) {
+	if nameValueMatch && index < len(StaticTable) {
+		return IndexHeaderField, IndexingInvalid
+	}
+	return LiteralHeaderField, IndexingWithout
+}
+
+// IndexAllStrategy adds every field that is not in the table yet.
+type IndexAllStrategy struct{}
+
+func (s IndexAllStrategy) Choose(field HeaderField, index int, nameValueMatch bool, table *HeaderTable) (representationType, indexingType) {
+	if nameValueMatch {
+		return IndexHeaderField, IndexingInvalid
+	}
+	return LiteralHeaderField, IndexingIncremental
+}
+
+// FrequencyStrategy only indexes fields that have been seen at least
+// MinCount times, and refuses to index a field if doing so would evict an
+// entry that has been used more often than the field itself. This keeps
+// one-off values such as request IDs from flushing hot entries like
+// user-agent or authority out of the table.
+type FrequencyStrategy struct {
+	MinCount   int
+	MaxTracked int
+
+	counts map[HeaderField]int
+}
+
+func NewFrequencyStrategy() *FrequencyStrategy {
+	return &FrequencyStrategy{
+		MinCount:   2,
+		MaxTracked: 1024,
+		counts:     make(map[HeaderField]int),
+	}
+}
+
+func (s *FrequencyStrategy) Choose(field HeaderField, index int, nameValueMatch bool, table *HeaderTable) (representationType, indexingType) {
+	count := s.count(field)
+	if nameValueMatch {
+		return IndexHeaderField, IndexingInvalid
+	}
+	if count < s.MinCount {
+		return LiteralHeaderField, IndexingWithout
+	}
+
+	for _, evicted := range table.evictionCandidates(field.Size()) {
+		if s.counts[evicted] > count {
+			return LiteralHeaderField, IndexingWithout
+		}
+	}
+	return LiteralHeaderField, IndexingIncremental
+}
+
+func (s *FrequencyStrategy) count(field HeaderField) int {
+	if s.counts == nil {
+		s.counts = make(map[HeaderField]int)
+	}
+
+	if _, ok := s.counts[field]; !ok && len(s.counts) >= s.MaxTracked {
+		// Age the counters so that the map stays bounded and stale
+		// fields are forgotten.
+		for f, c := range s.counts {
+			if c/2 == 0 {
+				delete(s.counts, f)
+			} else {
+				s.counts[f] = c / 2
+			}
+		}
+	}
+	s.counts[field]++
+	return s.counts[field]
+}
+
+// evictionCandidates returns the entries, oldest first, that would be
+// evicted to make room for a new entry of the given size.
+func (t *HeaderTable) evictionCandidates(size int) []HeaderField {
+	var result []HeaderField
+	available := t.MaxSize - t.size
+	for i := t.count - 1; i >= 0 && available < size; i-- {
+		entry := t.dynamicEntry(i)
+		result = append(result, *entry)
+		available += entry.Size()
+	}
+	return result
+}
+
+// EncodedSize returns the total number of octets a fresh HeaderEncoder using
+// strategy produces for a sequence of header blocks.
+func EncodedSize(strategy IndexingStrategy, blocks []HeaderList) (int, error) {
+	e := NewHeaderEncoder()
+	e.Strategy = strategy
+
+	size := 0
+	for _, hl := range blocks {
+		block, err := e.Encode(hl)
+		if err != nil {
+			return 0, err
+		}
+		size += len(block)
+	}
+	return size, nil
+}
+
+// CompareStrategies encodes the same header blocks with each strategy and
+// returns the resulting sizes by name.
+func CompareStrategies(blocks []HeaderList, strategies map[string]IndexingStrategy) (map[string]int, error) {
+	result := make(map[string]int)
+	for name, strategy := range strategies {
+		size, err := EncodedSize(strategy, blocks)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = size
+	}
+	return result, nil
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"encoding/hex"
+	"fmt"
 	"strings"
 	"testing"
 
@@ -33,16 +35,66 @@ func TestDecodeInteger(t *testing.T) {
 		input    []byte
 		n        int
 		expected int
+		length   int
 	}{
-		{[]byte{0x0a}, 5, 10},
-		{[]byte{0x1f, 0x9a, 0x0a}, 5, 1337},
-		{[]byte{0x2a}, 8, 42},
+		{[]byte{0x0a}, 5, 10, 1},
+		{[]byte{0x1f, 0x9a, 0x0a}, 5, 1337, 3},
+		{[]byte{0x2a}, 8, 42, 1},
+		{[]byte{0x1f, 0x9a, 0x0a, 0xff}, 5, 1337, 3},
 	}
 
 	for i := 0; i < len(testcases); i++ {
 		c := testcases[i]
-		actual := DecodeInteger(c.input, c.n)
+		actual, length, err := DecodeInteger(c.input, c.n)
+		assert.Nil(t, err)
 		assert.Equal(t, c.expected, actual)
+		assert.Equal(t, c.length, length)
+	}
+}
+
+func TestDecodeIntegerInvalid(t *testing.T) {
+	testcases := []struct {
+		input    []byte
+		n        int
+		expected error
+	}{
+		{[]byte{}, 5, errTruncated},
+		{[]byte{0x1f}, 5, errTruncated},
+		{[]byte{0x1f, 0x9a}, 5, errTruncated},
+		{[]byte{0x1f, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, 5, errIntegerOverflow},
+		{[]byte{0x1f, 0xff, 0xff, 0xff, 0xff, 0x0f}, 5, errIntegerOverflow},
+	}
+
+	for i := 0; i < len(testcases); i++ {
+		c := testcases[i]
+		_, _, err := DecodeInteger(c.input, c.n)
+		assert.Equal(t, c.expected, err)
+	}
+}
+
+func TestHeaderDecoderInvalid(t *testing.T) {
+	testcases := []struct {
+		input    string
+		expected error
+	}{
+		{"80", errInvalidIndex},
+		{"be", errInvalidIndex},
+		{"7f00", errInvalidIndex},
+		{"0f2f", errInvalidIndex},
+		{"ff", errTruncated},
+		{"4005", errTruncated},
+		{"400a637573746f6d2d6b6579", errTruncated},
+		{"440a2f", errTruncated},
+		{"3fffffffffff01", errIntegerOverflow},
+	}
+
+	for i := 0; i < len(testcases); i++ {
+		c := testcases[i]
+		input, err := hex.DecodeString(c.input)
+		assert.Nil(t, err)
+		d := NewHeaderDecoder()
+		_, err = d.Decode(input)
+		assert.Equal(t, DecodingError{c.expected}, err, c.input)
 	}
 }
 
@@ -58,6 +110,7 @@ func TestEncodeHuffmanCode(t *testing.T) {
 		{"private", "aec3771a4b"},
 		{"Mon, 21 Oct 2013 20:13:21 GMT", "d07abe941054d444a8200595040b8166e082a62d1bff"},
 		{"https://www.example.com", "9d29ad171863c78f0b97c8e9ae82ae43d3"},
+		{"00000000", "0000000000"},
 	}
 
 	for i := 0; i < len(testcases); i++ {
@@ -66,9 +119,17 @@ func TestEncodeHuffmanCode(t *testing.T) {
 		assert.Nil(t, err)
 		actual := EncodeHuffmanCode(c.input, false)
 		assert.Equal(t, expected, actual)
+		assert.Equal(t, len(expected), HuffmanEncodedLength(c.input))
 	}
 }
 
+func TestHuffmanEncodedLengthAllocs(t *testing.T) {
+	allocs := testing.AllocsPerRun(100, func() {
+		HuffmanEncodedLength("Mon, 21 Oct 2013 20:13:21 GMT")
+	})
+	assert.Equal(t, float64(0), allocs)
+}
+
 func TestDecodeHuffmanCode(t *testing.T) {
 	testcases := []struct {
 		expected string
@@ -87,11 +148,36 @@ func TestDecodeHuffmanCode(t *testing.T) {
 		c := testcases[i]
 		input, err := hex.DecodeString(c.input)
 		assert.Nil(t, err)
-		actual := DecodeHuffmanCode(input)
+		actual, err := DecodeHuffmanCode(input)
+		assert.Nil(t, err)
 		assert.Equal(t, c.expected, actual)
 	}
 }
 
+func TestDecodeHuffmanCodeInvalid(t *testing.T) {
+	testcases := []struct {
+		input    []byte
+		expected error
+	}{
+		{[]byte{0x1f, 0xff}, errHuffmanPadding},
+		{[]byte{0x18}, errHuffmanPadding},
+		{[]byte{0xff}, errHuffmanPadding},
+		{EncodeHuffmanCode("a", true), errHuffmanEOS},
+		// The EOS code ends inside the last octet.
+		{EncodeHuffmanCode("nrb", true), errHuffmanEOS},
+	}
+
+	for i := 0; i < len(testcases); i++ {
+		c := testcases[i]
+		_, err := DecodeHuffmanCode(c.input)
+		assert.Equal(t, c.expected, err)
+	}
+
+	d := NewHeaderDecoder()
+	_, err := d.Decode([]byte{0x00, 0x81, 0x18, 0x00})
+	assert.Equal(t, DecodingError{errHuffmanPadding}, err)
+}
+
 func TestEncodeHeaders(t *testing.T) {
 	testcases := []struct {
 		input    HeaderList
@@ -113,15 +199,438 @@ func TestEncodeHeaders(t *testing.T) {
 			HeaderList{
 				{"custom-key", "custom-value"},
 			},
-			"00 0a 637573746f6d2d6b6579 0c 637573746f6d2d76616c7565",
+			"00 88 25a849e95ba97d7f 89 25a849e95bb8e8b4bf",
+		},
+	}
+
+	for i := 0; i < len(testcases); i++ {
+		c := testcases[i]
+		expected, err := hex.DecodeString(strings.ReplaceAll(c.expected, " ", ""))
+		assert.Nil(t, err)
+		actual, err := EncodeHeaders(c.input)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, actual)
+	}
+}
+
+func TestHeaderEncoder(t *testing.T) {
+	// RFC 7541 C.4 Request Examples with Huffman Coding
+	testcases := []struct {
+		input    HeaderList
+		expected string
+		size     int
+	}{
+		{
+			HeaderList{
+				{":method", "GET"},
+				{":scheme", "http"},
+				{":path", "/"},
+				{":authority", "www.example.com"},
+			},
+			"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+			57,
+		},
+		{
+			HeaderList{
+				{":method", "GET"},
+				{":scheme", "http"},
+				{":path", "/"},
+				{":authority", "www.example.com"},
+				{"cache-control", "no-cache"},
+			},
+			"8286 84be 5886 a8eb 1064 9cbf",
+			110,
+		},
+		{
+			HeaderList{
+				{":method", "GET"},
+				{":scheme", "https"},
+				{":path", "/index.html"},
+				{":authority", "www.example.com"},
+				{"custom-key", "custom-value"},
+			},
+			"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+			164,
 		},
 	}
 
+	e := NewHeaderEncoder()
+	d := NewHeaderDecoder()
 	for i := 0; i < len(testcases); i++ {
 		c := testcases[i]
 		expected, err := hex.DecodeString(strings.ReplaceAll(c.expected, " ", ""))
 		assert.Nil(t, err)
-		actual := EncodeHeaders(c.input)
+		actual, err := e.Encode(c.input)
+		assert.Nil(t, err)
 		assert.Equal(t, expected, actual)
+		assert.Equal(t, c.size, e.getDynamicTableSize())
+
+		d.Decode(actual)
+		assert.Equal(t, e.Entries(), d.Entries())
+	}
+}
+
+func TestHeaderEncoderSizeUpdate(t *testing.T) {
+	e := NewHeaderEncoder()
+	_, err := e.Encode(HeaderList{{"custom-key", "custom-value"}})
+	assert.Nil(t, err)
+
+	e.SetMaxDynamicTableSizeLimit(0)
+	e.SetMaxDynamicTableSizeLimit(65536)
+	assert.Equal(t, 0, len(e.Entries()))
+
+	actual, err := e.Encode(HeaderList{{":method", "GET"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x20, 0x3f, 0xe1, 0x1f, 0x82}, actual)
+
+	actual, err = e.Encode(HeaderList{{":method", "GET"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x82}, actual)
+}
+
+// decodeHuffmanCodeBitwise is the previous bit-at-a-time decoder, kept as a
+// reference for the benchmarks.
+func decodeHuffmanCodeBitwise(data []byte) string {
+	result := []byte{}
+
+	var p uint32 = 0
+	s := 0
+	for i := 0; i < len(data); i++ {
+		for j := 0; j < 8; j++ {
+			b := byte((data[i] >> (8 - j - 1)) & 0x01)
+			p = p<<1 | uint32(b)
+			s++
+
+			for j := 0; j < 256; j++ {
+				if HuffmanTable[j].Code == p && HuffmanTable[j].BitLength == s {
+					result = append(result, byte(j))
+					s = 0
+					p = 0
+				}
+			}
+		}
+	}
+	return string(result)
+}
+
+func TestDecodeHuffmanCodeAllSymbols(t *testing.T) {
+	input := make([]byte, 256)
+	for i := 0; i < len(input); i++ {
+		input[i] = byte(i)
+	}
+	encoded := EncodeHuffmanCode(string(input), false)
+	actual, err := DecodeHuffmanCode(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, string(input), actual)
+	assert.Equal(t, decodeHuffmanCodeBitwise(encoded), actual)
+}
+
+var benchmarkHuffmanInput = EncodeHuffmanCode("Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/86.0.4240.75 Safari/537.36", false)
+
+func BenchmarkDecodeHuffmanCode(b *testing.B) {
+	b.SetBytes(int64(len(benchmarkHuffmanInput)))
+	for i := 0; i < b.N; i++ {
+		DecodeHuffmanCode(benchmarkHuffmanInput)
+	}
+}
+
+func BenchmarkDecodeHuffmanCodeBitwise(b *testing.B) {
+	b.SetBytes(int64(len(benchmarkHuffmanInput)))
+	for i := 0; i < b.N; i++ {
+		decodeHuffmanCodeBitwise(benchmarkHuffmanInput)
+	}
+}
+
+func TestHeaderDecoderLimits(t *testing.T) {
+	d := NewHeaderDecoder()
+	d.MaxStringLength = 8
+
+	// The raw value is too long.
+	_, err := d.Decode([]byte{0x00, 0x01, 0x61, 0x09, 0x61, 0x61, 0x61, 0x61, 0x61, 0x61, 0x61, 0x61, 0x61})
+	assert.Equal(t, DecodingError{errStringLength}, err)
+
+	// 5 Huffman-encoded octets expand to 8 "0" characters; 6 expand beyond
+	// the limit.
+	_, err = d.Decode(append([]byte{0x00, 0x01, 0x61, 0x85}, EncodeHuffmanCode("00000000", false)...))
+	assert.Nil(t, err)
+	_, err = d.Decode(append([]byte{0x00, 0x01, 0x61, 0x86}, EncodeHuffmanCode("000000000", false)...))
+	assert.Equal(t, DecodingError{errStringLength}, err)
+
+	// Size updates above SETTINGS_HEADER_TABLE_SIZE or after a field are
+	// rejected.
+	_, err = d.Decode(DumpDynamicTableSizeUpdate(8192))
+	assert.Equal(t, DecodingError{errTableSizeUpdate}, err)
+	_, err = d.Decode(append([]byte{0x82}, DumpDynamicTableSizeUpdate(0)...))
+	assert.Equal(t, DecodingError{errTableSizeUpdate}, err)
+	_, err = d.Decode(append(DumpDynamicTableSizeUpdate(0), DumpDynamicTableSizeUpdate(4096)...))
+	assert.Nil(t, err)
+}
+
+func TestHeaderDecoderMaxHeaderListSize(t *testing.T) {
+	d := NewHeaderDecoder()
+	d.MaxHeaderListSize = 100
+
+	h := HeaderField{"x-bomb", strings.Repeat("a", 60)}
+	literal, err := h.DumpLiteralHeaderFieldWithNewdName(IndexingIncremental)
+	assert.Nil(t, err)
+
+	// Every further reference to the indexed entry adds 98 octets.
+	block := append(literal, bytes.Repeat([]byte{0xbe}, 1000)...)
+	block = append(block, 0x40, 0x01, 0x62, 0x01, 0x62)
+	_, err = d.Decode(block)
+	assert.Equal(t, ErrHeaderListSize, err)
+
+	// The block was processed to the end, so the table is still in sync.
+	assert.Equal(t, []HeaderField{{"b", "b"}, h}, d.Entries())
+}
+
+func TestHeaderEncoderSensitiveHeaders(t *testing.T) {
+	e := NewHeaderEncoder()
+	e.SensitiveHeaders = []string{"X-Api-Key"}
+
+	input := HeaderList{
+		{"authorization", "Bearer token"},
+		{"proxy-authorization", "Basic dXNlcjpwYXNz"},
+		{"cookie", "sid=1"},
+		{"cookie", "preferences=dark-mode-enabled"},
+		{"x-api-key", "secret"},
+		{"x-public", "value"},
+	}
+	block, err := e.Encode(input)
+	assert.Nil(t, err)
+
+	// Only the long cookie and the public header are indexed.
+	assert.Equal(t, []HeaderField{input[5], input[3]}, e.Entries())
+
+	d := NewHeaderDecoder()
+	fields, err := d.DecodeFormats(block)
+	assert.Nil(t, err)
+	assert.Equal(t, len(input), len(fields))
+	expected := []bool{true, true, true, false, true, false}
+	for i := 0; i < len(fields); i++ {
+		assert.Equal(t, input[i], fields[i].HeaderField)
+		assert.Equal(t, expected[i], fields[i].NeverIndexed(), fields[i].Name)
+	}
+
+	// A sensitive field is never replaced by an index, even on repetition.
+	block, err = e.Encode(HeaderList{{"authorization", "Bearer token"}})
+	assert.Nil(t, err)
+	assert.Equal(t, byte(0x1f), block[0])
+
+	// Each crumb of a long cookie is judged on its own: short crumbs are
+	// never indexed, crumbs of 20 octets or more are.
+	crumbs := HeaderList{
+		{"cookie", "a=1"},
+		{"cookie", "theme=dark-mode-one"},
+		{"cookie", "theme=dark-mode-auto"},
+		{"cookie", "session=0123456789abcdef"},
+	}
+	block, err = e.Encode(crumbs)
+	assert.Nil(t, err)
+	fields, err = d.DecodeFormats(block)
+	assert.Nil(t, err)
+	expected = []bool{true, true, false, false}
+	for i := 0; i < len(fields); i++ {
+		assert.Equal(t, crumbs[i], fields[i].HeaderField)
+		assert.Equal(t, expected[i], fields[i].NeverIndexed(), fields[i].Value)
+	}
+	assert.Equal(t, []HeaderField{crumbs[3], crumbs[2], input[5], input[3]}, e.Entries())
+}
+
+func TestHeaderTable(t *testing.T) {
+	table := newHeaderTable(3 * 34)
+	for _, name := range []string{"a", "b", "c", "a", "d"} {
+		table.insertIntoDynamicTable(HeaderField{name, name})
+	}
+
+	assert.Equal(t, []HeaderField{{"d", "d"}, {"a", "a"}, {"c", "c"}}, table.Entries())
+	assert.Equal(t, 3*34, table.getDynamicTableSize())
+	assert.Equal(t, &HeaderField{"d", "d"}, table.getTableValue(62))
+	assert.Equal(t, &HeaderField{"c", "c"}, table.getTableValue(64))
+	assert.Nil(t, table.getTableValue(65))
+
+	// "a" was inserted twice; evicting the older copy keeps the newer one.
+	index, match := table.search(HeaderField{"a", "a"})
+	assert.Equal(t, 63, index)
+	assert.True(t, match)
+	index, match = table.search(HeaderField{"b", "b"})
+	assert.Equal(t, 0, index)
+	assert.False(t, match)
+	index, match = table.search(HeaderField{"c", "x"})
+	assert.Equal(t, 64, index)
+	assert.False(t, match)
+
+	// Static entries take precedence and the lowest static index wins.
+	index, match = table.search(HeaderField{":path", "/index.html"})
+	assert.Equal(t, 5, index)
+	assert.True(t, match)
+	index, match = table.search(HeaderField{":status", "418"})
+	assert.Equal(t, 8, index)
+	assert.False(t, match)
+
+	table.MaxSize = 34
+	table.evictEntry()
+	assert.Equal(t, []HeaderField{{"d", "d"}}, table.Entries())
+	index, _ = table.search(HeaderField{"a", "a"})
+	assert.Equal(t, 0, index)
+}
+
+var benchmarkHeaderList = HeaderList{
+	{":method", "GET"},
+	{":scheme", "https"},
+	{":path", "/api/v1/items?page=2"},
+	{":authority", "www.example.com"},
+	{"user-agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/86.0.4240.75 Safari/537.36"},
+	{"accept", "application/json"},
+	{"accept-encoding", "gzip, deflate, br"},
+	{"accept-language", "en-US,en;q=0.9"},
+	{"cookie", "session=0123456789abcdef0123456789abcdef"},
+	{"x-request-id", "4e8f1a2b-6c3d-4e5f-8a9b-0c1d2e3f4a5b"},
+}
+
+func BenchmarkHeaderTableInsert(b *testing.B) {
+	table := newHeaderTable(4096)
+	for i := 0; i < b.N; i++ {
+		table.insertIntoDynamicTable(benchmarkHeaderList[i%len(benchmarkHeaderList)])
+	}
+}
+
+func BenchmarkHeaderTableSearch(b *testing.B) {
+	table := newHeaderTable(4096)
+	for _, h := range benchmarkHeaderList {
+		table.insertIntoDynamicTable(h)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.search(benchmarkHeaderList[i%len(benchmarkHeaderList)])
+	}
+}
+
+func BenchmarkHeaderEncoder(b *testing.B) {
+	e := NewHeaderEncoder()
+	for i := 0; i < b.N; i++ {
+		e.Encode(benchmarkHeaderList)
+	}
+}
+
+func TestIndexingStrategies(t *testing.T) {
+	request := func(id string) HeaderList {
+		return HeaderList{
+			{":method", "GET"},
+			{":path", "/"},
+			{"user-agent", "http2client/1.0 (compatible; testing)"},
+			{"x-request-id", id},
+		}
+	}
+
+	var blocks []HeaderList
+	for i := 0; i < 20; i++ {
+		blocks = append(blocks, request(fmt.Sprintf("%08x-%08x", i, i*7919)))
+	}
+
+	sizes, err := CompareStrategies(blocks, map[string]IndexingStrategy{
+		"static":    StaticOnlyStrategy{},
+		"all":       IndexAllStrategy{},
+		"frequency": NewFrequencyStrategy(),
+	})
+	assert.Nil(t, err)
+	assert.Less(t, sizes["all"], sizes["static"])
+	assert.Less(t, sizes["frequency"], sizes["static"])
+
+	// Every strategy must produce blocks the decoder understands.
+	for _, strategy := range []IndexingStrategy{StaticOnlyStrategy{}, IndexAllStrategy{}, NewFrequencyStrategy()} {
+		e := NewHeaderEncoder()
+		e.Strategy = strategy
+		d := NewHeaderDecoder()
+		for _, hl := range blocks {
+			block, err := e.Encode(hl)
+			assert.Nil(t, err)
+			fields, err := d.Decode(block)
+			assert.Nil(t, err)
+			assert.Equal(t, []HeaderField(hl), fields)
+		}
+	}
+}
+
+func TestStaticOnlyStrategy(t *testing.T) {
+	e := NewHeaderEncoder()
+	e.Strategy = StaticOnlyStrategy{}
+	for i := 0; i < 2; i++ {
+		block, err := e.Encode(HeaderList{{":method", "GET"}, {"custom-key", "custom-value"}})
+		assert.Nil(t, err)
+		assert.Equal(t, byte(0x82), block[0])
+		assert.Equal(t, byte(0x00), block[1])
+	}
+	assert.Empty(t, e.Entries())
+}
+
+func TestFrequencyStrategy(t *testing.T) {
+	e := NewHeaderEncoder()
+	e.SetMaxDynamicTableSizeLimit(100)
+	e.Strategy = NewFrequencyStrategy()
+
+	hot := HeaderField{"x-hot", "value-that-repeats"}
+	for i := 0; i < 3; i++ {
+		_, err := e.Encode(HeaderList{hot})
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []HeaderField{hot}, e.Entries())
+
+	// A field seen once is not indexed at all.
+	_, err := e.Encode(HeaderList{{"x-once", "1"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []HeaderField{hot}, e.Entries())
+
+	// A field seen less often than the hot entry does not evict it.
+	cold := HeaderField{"x-cold", "a-rather-long-value-to-evict"}
+	for i := 0; i < 2; i++ {
+		_, err := e.Encode(HeaderList{cold})
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []HeaderField{hot}, e.Entries())
+}
+
+func TestHeaderDecoderWrite(t *testing.T) {
+	input := HeaderList{
+		{":method", "GET"},
+		{":path", "/index.html"},
+		{"custom-key", "custom-value"},
+		{"x-raw", strings.Repeat("\x00", 40)},
+		{"custom-key", "custom-value"},
 	}
+	block, err := NewHeaderEncoder().Encode(input)
+	assert.Nil(t, err)
+
+	// Feed the block one octet at a time; each field must be emitted as
+	// soon as its last octet has been written.
+	d := NewHeaderDecoder()
+	var fields []HeaderField
+	d.SetEmitFunc(func(f HeaderFieldFormat) {
+		fields = append(fields, f.HeaderField)
+	})
+	var lengths []int
+	for i := 0; i < len(block); i++ {
+		n, err := d.Write(block[i : i+1])
+		assert.Nil(t, err)
+		assert.Equal(t, 1, n)
+		if len(lengths) == 0 || lengths[len(lengths)-1] != len(fields) {
+			lengths = append(lengths, len(fields))
+		}
+	}
+	assert.Nil(t, d.Close())
+	assert.Equal(t, []HeaderField(input), fields)
+	assert.Equal(t, []int{1, 2, 3, 4, 5}, lengths)
+	assert.Equal(t, 2, len(d.Entries()))
+
+	// A block that ends in the middle of a representation is rejected.
+	d.SetEmitFunc(nil)
+	_, err = d.Write([]byte{0x40, 0x0a})
+	assert.Nil(t, err)
+	assert.Equal(t, DecodingError{errTruncated}, d.Close())
+	assert.Equal(t, 2, len(d.Entries()))
+
+	// An oversized literal is rejected before it is buffered.
+	d.MaxStringLength = 16
+	_, err = d.Write([]byte{0x00, 0x7f, 0x80, 0x01})
+	assert.Equal(t, DecodingError{errStringLength}, err)
 }
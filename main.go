@@ -3,9 +3,17 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "hpack" {
+		if err := hpackCommand(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	conn, err := DialTls(":8443")
 	if err != nil {
 		log.Fatal(err)
@@ -14,9 +22,7 @@ func main() {
 
 	conn.StartHTTP2()
 
-	resp, err := conn.Request("GET", "/", []HeaderField{
-		{"host", "localhost"},
-	})
+	resp, err := conn.RequestRawURL("GET", "https://localhost:8443/", nil)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/rand"
+	"math/big"
+)
+
+// PaddingPolicy decides how many padding octets are added to an outgoing
+// DATA or HEADERS frame whose unpadded payload is length octets long.
+// When padded is false the PADDED flag is not set at all.
+type PaddingPolicy interface {
+	Pad(length int) (padLength int, padded bool)
+}
+
+type NoPadding struct{}
+
+func (p NoPadding) Pad(length int) (int, bool) {
+	return 0, false
+}
+
+type FixedPadding struct {
+	Length int
+}
+
+func (p FixedPadding) Pad(length int) (int, bool) {
+	return p.Length, true
+}
+
+type RandomPadding struct {
+	Max int
+}
+
+func (p RandomPadding) Pad(length int) (int, bool) {
+	if p.Max <= 0 {
+		return 0, true
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(p.Max)+1))
+	if err != nil {
+		return p.Max, true
+	}
+	return int(n.Int64()), true
+}
+
+// BucketPadding pads the payload, including the Pad Length field, up to
+// the next multiple of Size.
+type BucketPadding struct {
+	Size int
+}
+
+func (p BucketPadding) Pad(length int) (int, bool) {
+	if p.Size <= 0 {
+		return 0, true
+	}
+	return (p.Size - (length+1)%p.Size) % p.Size, true
+}
+
+func (c *Connection) padLength(length int) (byte, bool) {
+	if c.Padding == nil {
+		return 0, false
+	}
+
+	padLength, padded := c.Padding.Pad(length)
+	if !padded {
+		return 0, false
+	}
+
+	max := c.peerMaxFrameSize() - length - 1
+	if max < 0 {
+		return 0, false
+	}
+	if max > 255 {
+		max = 255
+	}
+	if padLength < 0 {
+		padLength = 0
+	} else if padLength > max {
+		padLength = max
+	}
+	return byte(padLength), true
+}
+
+func (c *Connection) newHeadersFrame(sid uint32, flags Flags, fragment []byte) *HeadersFrame {
+	hf := HeadersFrame{
+		FrameBase: FrameBase{
+			Header: FrameHeader{
+				Length:           0,
+				Type:             FrameTypeHeaders,
+				Flags:            flags,
+				StreamIdentifier: sid,
+			},
+		},
+		Payload: HeadersPayload{
+			PadLength:           0,
+			E:                   0,
+			StreamDependency:    0,
+			Weight:              0,
+			HeaderBlockFragment: fragment,
+		},
+	}
+
+	if padLength, padded := c.padLength(len(fragment)); padded {
+		hf.Header.Flags |= FlagsPadded
+		hf.Payload.PadLength = padLength
+	}
+	hf.Header.Length = uint32(len(hf.Payload.Serialize(hf.Header.Flags.Has(FlagsPadded), hf.Header.Flags.Has(FlagsFlagsPriority))))
+	return &hf
+}
+
+func (c *Connection) newDataFrame(sid uint32, flags Flags, data []byte) *DataFrame {
+	df := DataFrame{
+		FrameBase: FrameBase{
+			Header: FrameHeader{
+				Length:           0,
+				Type:             FrameTypeData,
+				Flags:            flags,
+				StreamIdentifier: sid,
+			},
+		},
+		Payload: DataPayload{
+			PadLength: 0,
+			Data:      data,
+		},
+	}
+
+	if padLength, padded := c.padLength(len(data)); padded {
+		df.Header.Flags |= FlagsPadded
+		df.Payload.PadLength = padLength
+	}
+	df.Header.Length = uint32(len(df.Payload.Serialize(df.Header.Flags.Has(FlagsPadded))))
+	return &df
+}
+
+// newDataFrameWithin is like newDataFrame, but keeps the frame payload,
+// which counts against flow control including its padding, within window
+// octets. It returns the frame and the number of octets of data it
+// carries.
+func (c *Connection) newDataFrameWithin(sid uint32, flags Flags, data []byte, window int) (*DataFrame, int) {
+	if len(data) > window {
+		data = data[:window]
+	}
+	df := c.newDataFrame(sid, flags, data)
+
+	if excess := int(df.Header.Length) - window; excess > 0 {
+		if int(df.Payload.PadLength) >= excess {
+			df.Payload.PadLength -= byte(excess)
+		} else {
+			df.Header.Flags &^= FlagsPadded
+			df.Payload.PadLength = 0
+		}
+		df.Header.Length = uint32(len(df.Payload.Serialize(df.Header.Flags.Has(FlagsPadded))))
+	}
+	return df, len(data)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// dial opens a TCP connection to address for an origin with the given
+// scheme.
+func (d *Dialer) dial(scheme, address string) (net.Conn, error) {
+	var proxy *url.URL
+	if d.Proxy != nil {
+		var err error
+		if proxy, err = d.Proxy(scheme, address); err != nil {
+			return nil, err
+		}
+	}
+
+	if proxy == nil {
+		return net.Dial("tcp", address)
+	}
+	switch proxy.Scheme {
+	case "http", "https":
+		return d.dialHTTPProxy(proxy, address)
+	case "socks5", "socks5h":
+		return dialSOCKS5(proxy, address)
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", proxy.Scheme)
+}
+
+// proxyAddress returns the host and port of a proxy URL.
+func proxyAddress(proxy *url.URL) string {
+	if proxy.Port() != "" {
+		return proxy.Host
+	}
+	switch proxy.Scheme {
+	case "https":
+		return net.JoinHostPort(proxy.Hostname(), "443")
+	case "socks5", "socks5h":
+		return net.JoinHostPort(proxy.Hostname(), "1080")
+	}
+	return net.JoinHostPort(proxy.Hostname(), "80")
+}
+
+// dialHTTPProxy asks an HTTP/1.1 proxy for a tunnel to address with the
+// CONNECT method. User information in the proxy URL is sent as Basic
+// credentials in Proxy-Authorization.
+func (d *Dialer) dialHTTPProxy(proxy *url.URL, address string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", proxyAddress(proxy))
+	if err != nil {
+		return nil, err
+	}
+
+	if proxy.Scheme == "https" {
+		config := &tls.Config{}
+		if d.ProxyTLSConfig != nil {
+			config = d.ProxyTLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = proxy.Hostname()
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	var request strings.Builder
+	fmt.Fprintf(&request, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		fmt.Fprintf(&request, "Proxy-Authorization: Basic %s\r\n", credentials)
+	}
+	request.WriteString("\r\n")
+	if _, err := io.WriteString(conn, request.String()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	tp := textproto.NewReader(reader)
+	status, err := tp.ReadLine()
+	if err == nil {
+		_, err = tp.ReadMIMEHeader()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading proxy response: %v", err)
+	}
+
+	// HTTP/1.1 200 Connection established
+	fields := strings.SplitN(status, " ", 3)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/1.") || len(fields[1]) != 3 {
+		conn.Close()
+		return nil, fmt.Errorf("malformed proxy response %q", status)
+	}
+	if fields[1][0] != '2' {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT: %s", strings.Join(fields[1:], " "))
+	}
+
+	if reader.Buffered() > 0 {
+		return &bufferedConn{conn, reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose reader already holds some of the
+// data that was received.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+var socks5Replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// dialSOCKS5 connects to address through a SOCKS5 proxy (RFC 1928), with
+// username/password authentication (RFC 1929) if the proxy URL has user
+// information. With socks5h the proxy resolves host names, with socks5 we
+// do.
+func dialSOCKS5(proxy *url.URL, address string) (net.Conn, error) {
+	host, portName, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.LookupPort("tcp", portName)
+	if err != nil {
+		return nil, err
+	}
+
+	request := []byte{0x05, 0x01, 0x00}
+	ip := net.ParseIP(host)
+	if ip == nil && proxy.Scheme == "socks5" {
+		addrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+		if err != nil {
+			return nil, err
+		}
+		ip = addrs[0].IP
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		request = append(append(request, 0x01), ip4...)
+	} else if ip != nil {
+		request = append(append(request, 0x04), ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name %q too long for SOCKS5", host)
+		}
+		request = append(append(request, 0x03, byte(len(host))), host...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+
+	conn, err := net.Dial("tcp", proxyAddress(proxy))
+	if err != nil {
+		return nil, err
+	}
+	if err := socks5Handshake(conn, proxy.User, request); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks5: %v", err)
+	}
+	return conn, nil
+}
+
+func socks5Handshake(conn net.Conn, user *url.Userinfo, request []byte) error {
+	methods := []byte{0x00}
+	if user != nil {
+		methods = append(methods, 0x02)
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return errors.New("not a SOCKS5 proxy")
+	}
+	switch {
+	case reply[1] == 0x00:
+	case reply[1] == 0x02 && user != nil:
+		username := user.Username()
+		password, _ := user.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("username or password too long")
+		}
+		auth := append([]byte{0x01, byte(len(username))}, username...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("authentication failed")
+		}
+	default:
+		return errors.New("no acceptable authentication method")
+	}
+
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	reply = make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		if text, ok := socks5Replies[reply[1]]; ok {
+			return errors.New(text)
+		}
+		return fmt.Errorf("unknown reply 0x%02x", reply[1])
+	}
+
+	// The bound address is of no use to us.
+	var length int
+	switch reply[3] {
+	case 0x01:
+		length = 4
+	case 0x04:
+		length = 16
+	case 0x03:
+		if _, err := io.ReadFull(conn, reply[:1]); err != nil {
+			return err
+		}
+		length = int(reply[0])
+	default:
+		return fmt.Errorf("unknown address type 0x%02x", reply[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, length+2))
+	return err
+}
+
+// ProxyFromEnvironment returns the proxy for an origin from HTTPS_PROXY or
+// HTTP_PROXY, depending on the scheme, unless NO_PROXY excludes address.
+// The lowercase variables are used if the uppercase ones are not set.
+// Connections to localhost are never proxied.
+func ProxyFromEnvironment(scheme, address string) (*url.URL, error) {
+	return proxyFromEnv(os.Getenv, scheme, address)
+}
+
+func proxyFromEnv(getenv func(string) string, scheme, address string) (*url.URL, error) {
+	var proxy string
+	switch scheme {
+	case "https":
+		proxy = getenvAny(getenv, "HTTPS_PROXY", "https_proxy")
+	case "http":
+		proxy = getenvAny(getenv, "HTTP_PROXY", "http_proxy")
+	}
+	if proxy == "" || !useProxy(getenvAny(getenv, "NO_PROXY", "no_proxy"), address) {
+		return nil, nil
+	}
+
+	// A proxy without a scheme is an HTTP proxy.
+	u, err := url.Parse(proxy)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		if u, err := url.Parse("http://" + proxy); err == nil {
+			return u, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy address %q: %v", proxy, err)
+	}
+	return u, nil
+}
+
+func getenvAny(getenv func(string) string, names ...string) string {
+	for _, name := range names {
+		if value := getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// useProxy reports whether address is not excluded by noProxy, a list of
+// host names, domains, IP addresses and CIDR ranges separated by commas
+// or spaces, optionally with a port. A domain such as "example.com" or
+// ".example.com" matches the domain itself and all subdomains, and "*"
+// matches everything.
+func useProxy(noProxy, address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	if host == "localhost" || ip != nil && ip.IsLoopback() {
+		return false
+	}
+
+	for _, entry := range strings.FieldsFunc(strings.ToLower(noProxy), func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		if entry == "*" {
+			return false
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return false
+			}
+			continue
+		}
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entry = h
+		}
+
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			if entryIP.Equal(ip) {
+				return false
+			}
+			continue
+		}
+		entry = strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return false
+		}
+	}
+	return true
+}
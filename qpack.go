@@ -0,0 +1,882 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// QPACK (RFC 9204) header compression for HTTP/3. The codecs work on byte
+// streams only: field sections are passed in and out as byte slices, and
+// the encoder and decoder streams are exchanged with WriteEncoderStream,
+// EncoderStream, WriteDecoderStream and DecoderStream.
+
+type QPACKErrorCode uint64
+
+const (
+	QPACKDecompressionFailed QPACKErrorCode = 0x200
+	QPACKEncoderStreamError  QPACKErrorCode = 0x201
+	QPACKDecoderStreamError  QPACKErrorCode = 0x202
+)
+
+var qpackErrorCodeNames = map[QPACKErrorCode]string{
+	QPACKDecompressionFailed: "QPACK_DECOMPRESSION_FAILED",
+	QPACKEncoderStreamError:  "QPACK_ENCODER_STREAM_ERROR",
+	QPACKDecoderStreamError:  "QPACK_DECODER_STREAM_ERROR",
+}
+
+func (c QPACKErrorCode) String() string {
+	if name, ok := qpackErrorCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("QPACK_ERROR_%#x", uint64(c))
+}
+
+// QPACKError is a connection error of type Code.
+type QPACKError struct {
+	Code QPACKErrorCode
+	Err  error
+}
+
+func (e QPACKError) Error() string {
+	return fmt.Sprintf("qpack: %v: %v", e.Code, e.Err)
+}
+
+var (
+	// ErrQPACKBlocked is returned by QPACKDecoder.DecodeFieldSection when
+	// the field section refers to entries that have not arrived on the
+	// encoder stream yet. The section is kept and decoded once they have.
+	ErrQPACKBlocked = errors.New("qpack: field section blocked")
+
+	errQPACKRequiredInsertCount = errors.New("invalid required insert count")
+	errQPACKBlockedStreams      = errors.New("too many blocked streams")
+	errQPACKTableCapacity       = errors.New("dynamic table capacity exceeded")
+	errQPACKEntryTooLarge       = errors.New("entry larger than the dynamic table capacity")
+	errQPACKUnknownStream       = errors.New("acknowledgment for unknown stream")
+	errQPACKInsertCount         = errors.New("invalid insert count increment")
+	errQPACKEntriesInUse        = errors.New("entries still in use")
+)
+
+var QPACKStaticTable = []HeaderField{
+	{":authority", ""},
+	{":path", "/"},
+	{"age", "0"},
+	{"content-disposition", ""},
+	{"content-length", "0"},
+	{"cookie", ""},
+	{"date", ""},
+	{"etag", ""},
+	{"if-modified-since", ""},
+	{"if-none-match", ""},
+	{"last-modified", ""},
+	{"link", ""},
+	{"location", ""},
+	{"referer", ""},
+	{"set-cookie", ""},
+	{":method", "CONNECT"},
+	{":method", "DELETE"},
+	{":method", "GET"},
+	{":method", "HEAD"},
+	{":method", "OPTIONS"},
+	{":method", "POST"},
+	{":method", "PUT"},
+	{":scheme", "http"},
+	{":scheme", "https"},
+	{":status", "103"},
+	{":status", "200"},
+	{":status", "304"},
+	{":status", "404"},
+	{":status", "503"},
+	{"accept", "*/*"},
+	{"accept", "application/dns-message"},
+	{"accept-encoding", "gzip, deflate, br"},
+	{"accept-ranges", "bytes"},
+	{"access-control-allow-headers", "cache-control"},
+	{"access-control-allow-headers", "content-type"},
+	{"access-control-allow-origin", "*"},
+	{"cache-control", "max-age=0"},
+	{"cache-control", "max-age=2592000"},
+	{"cache-control", "max-age=604800"},
+	{"cache-control", "no-cache"},
+	{"cache-control", "no-store"},
+	{"cache-control", "public, max-age=31536000"},
+	{"content-encoding", "br"},
+	{"content-encoding", "gzip"},
+	{"content-type", "application/dns-message"},
+	{"content-type", "application/javascript"},
+	{"content-type", "application/json"},
+	{"content-type", "application/x-www-form-urlencoded"},
+	{"content-type", "image/gif"},
+	{"content-type", "image/jpeg"},
+	{"content-type", "image/png"},
+	{"content-type", "text/css"},
+	{"content-type", "text/html; charset=utf-8"},
+	{"content-type", "text/plain"},
+	{"content-type", "text/plain;charset=utf-8"},
+	{"range", "bytes=0-"},
+	{"strict-transport-security", "max-age=31536000"},
+	{"strict-transport-security", "max-age=31536000; includesubdomains"},
+	{"strict-transport-security", "max-age=31536000; includesubdomains; preload"},
+	{"vary", "accept-encoding"},
+	{"vary", "origin"},
+	{"x-content-type-options", "nosniff"},
+	{"x-xss-protection", "1; mode=block"},
+	{":status", "100"},
+	{":status", "204"},
+	{":status", "206"},
+	{":status", "302"},
+	{":status", "400"},
+	{":status", "403"},
+	{":status", "421"},
+	{":status", "425"},
+	{":status", "500"},
+	{"accept-language", ""},
+	{"access-control-allow-credentials", "FALSE"},
+	{"access-control-allow-credentials", "TRUE"},
+	{"access-control-allow-headers", "*"},
+	{"access-control-allow-methods", "get"},
+	{"access-control-allow-methods", "get, post, options"},
+	{"access-control-allow-methods", "options"},
+	{"access-control-expose-headers", "content-length"},
+	{"access-control-request-headers", "content-type"},
+	{"access-control-request-method", "get"},
+	{"access-control-request-method", "post"},
+	{"alt-svc", "clear"},
+	{"authorization", ""},
+	{"content-security-policy", "script-src 'none'; object-src 'none'; base-uri 'none'"},
+	{"early-data", "1"},
+	{"expect-ct", ""},
+	{"forwarded", ""},
+	{"if-range", ""},
+	{"origin", ""},
+	{"purpose", "prefetch"},
+	{"server", ""},
+	{"timing-allow-origin", "*"},
+	{"upgrade-insecure-requests", "1"},
+	{"user-agent", ""},
+	{"x-forwarded-for", ""},
+	{"x-frame-options", "deny"},
+	{"x-frame-options", "sameorigin"},
+}
+
+var (
+	qpackStaticByName      = make(map[string]int)
+	qpackStaticByNameValue = make(map[HeaderField]int)
+)
+
+func init() {
+	for i := len(QPACKStaticTable) - 1; i >= 0; i-- {
+		qpackStaticByName[QPACKStaticTable[i].Name] = i
+		qpackStaticByNameValue[QPACKStaticTable[i]] = i
+	}
+}
+
+// absoluteEntry returns the dynamic table entry with the given absolute
+// index, i.e. the ID it was inserted with, or nil if it has been evicted or
+// not inserted yet.
+func (t *HeaderTable) absoluteEntry(id uint64) *HeaderField {
+	if id >= t.nextID || id < t.nextID-uint64(t.count) {
+		return nil
+	}
+	return t.dynamicEntry(int(t.nextID - 1 - id))
+}
+
+// qpackMaxEntries is MaxEntries of RFC 9204 3.2.2.
+func qpackMaxEntries(maxTableCapacity int) uint64 {
+	return uint64(maxTableCapacity / 32)
+}
+
+func encodeRequiredInsertCount(ric uint64, maxTableCapacity int) int {
+	if ric == 0 {
+		return 0
+	}
+	return int(ric%(2*qpackMaxEntries(maxTableCapacity))) + 1
+}
+
+func decodeRequiredInsertCount(encoded int, maxTableCapacity int, totalInserts uint64) (uint64, error) {
+	if encoded == 0 {
+		return 0, nil
+	}
+
+	maxEntries := qpackMaxEntries(maxTableCapacity)
+	fullRange := 2 * maxEntries
+	if uint64(encoded) > fullRange {
+		return 0, errQPACKRequiredInsertCount
+	}
+
+	maxValue := totalInserts + maxEntries
+	maxWrapped := maxValue / fullRange * fullRange
+	ric := maxWrapped + uint64(encoded) - 1
+	if ric > maxValue {
+		if ric <= fullRange {
+			return 0, errQPACKRequiredInsertCount
+		}
+		ric -= fullRange
+	}
+	if ric == 0 {
+		return 0, errQPACKRequiredInsertCount
+	}
+	return ric, nil
+}
+
+type qpackSection struct {
+	requiredInsertCount uint64
+	minReference        uint64
+}
+
+// QPACKEncoder compresses field sections. Instructions for the peer's
+// decoder accumulate until they are collected with EncoderStream, and the
+// peer's decoder stream is fed back with WriteDecoderStream.
+type QPACKEncoder struct {
+	table HeaderTable
+
+	// maxTableCapacity and maxBlockedStreams are the peer's
+	// SETTINGS_QPACK_MAX_TABLE_CAPACITY and SETTINGS_QPACK_BLOCKED_STREAMS.
+	maxTableCapacity  int
+	maxBlockedStreams int
+
+	// SensitiveHeaders lists further header names that are always sent as
+	// literals that intermediaries must not index.
+	SensitiveHeaders []string
+
+	knownReceivedCount uint64
+	sections           map[uint64][]qpackSection
+	encoderStream      []byte
+	pending            []byte
+}
+
+func NewQPACKEncoder(maxTableCapacity, maxBlockedStreams int) *QPACKEncoder {
+	return &QPACKEncoder{
+		table:             newHeaderTable(0),
+		maxTableCapacity:  maxTableCapacity,
+		maxBlockedStreams: maxBlockedStreams,
+		sections:          make(map[uint64][]qpackSection),
+	}
+}
+
+// SetCapacity sets the dynamic table capacity and queues the Set Dynamic
+// Table Capacity instruction. The table starts with a capacity of 0.
+func (e *QPACKEncoder) SetCapacity(capacity int) error {
+	if capacity > e.maxTableCapacity {
+		return errQPACKTableCapacity
+	}
+	if !e.canEvict(e.table.size-capacity, math.MaxUint64) {
+		return errQPACKEntriesInUse
+	}
+
+	d := EncodeInteger(capacity, 5)
+	d[0] |= 0x20
+	e.encoderStream = append(e.encoderStream, d...)
+	e.table.MaxSize = capacity
+	e.table.evictEntry()
+	return nil
+}
+
+// Entries returns a copy of the dynamic table, newest entry first.
+func (e *QPACKEncoder) Entries() []HeaderField {
+	return e.table.Entries()
+}
+
+// EncoderStream returns the encoder instructions queued since the last
+// call.
+func (e *QPACKEncoder) EncoderStream() []byte {
+	result := e.encoderStream
+	e.encoderStream = nil
+	return result
+}
+
+// minReference returns the oldest entry referenced by a field section the
+// decoder has not acknowledged yet.
+func (e *QPACKEncoder) minReference() uint64 {
+	min := uint64(math.MaxUint64)
+	for _, sections := range e.sections {
+		for _, s := range sections {
+			if s.minReference < min {
+				min = s.minReference
+			}
+		}
+	}
+	return min
+}
+
+// canEvict reports whether size octets can be freed by evicting entries
+// older than minReference.
+func (e *QPACKEncoder) canEvict(size int, minReference uint64) bool {
+	if r := e.minReference(); r < minReference {
+		minReference = r
+	}
+
+	freed := 0
+	for id := e.table.nextID - uint64(e.table.count); freed < size; id++ {
+		if id >= minReference || id >= e.table.nextID {
+			return false
+		}
+		freed += e.table.absoluteEntry(id).Size()
+	}
+	return true
+}
+
+func (e *QPACKEncoder) blockedStreams() int {
+	n := 0
+	for _, sections := range e.sections {
+		for _, s := range sections {
+			if s.requiredInsertCount > e.knownReceivedCount {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+// canBlock reports whether the section being encoded on streamID may refer
+// to entries the decoder might not have received yet.
+func (e *QPACKEncoder) canBlock(streamID uint64, blocking bool) bool {
+	if blocking {
+		return true
+	}
+	for _, s := range e.sections[streamID] {
+		if s.requiredInsertCount > e.knownReceivedCount {
+			return true
+		}
+	}
+	return e.blockedStreams() < e.maxBlockedStreams
+}
+
+// insert queues an insert instruction for field and adds it to the table.
+func (e *QPACKEncoder) insert(field HeaderField) {
+	if i, ok := qpackStaticByName[field.Name]; ok {
+		d := EncodeInteger(i, 6)
+		d[0] |= 0xc0
+		e.encoderStream = append(e.encoderStream, d...)
+	} else if id, ok := e.table.byName[field.Name]; ok {
+		d := EncodeInteger(int(e.table.nextID-1-id), 6)
+		d[0] |= 0x80
+		e.encoderStream = append(e.encoderStream, d...)
+	} else {
+		e.encoderStream = appendPrefixedStringLiteral(e.encoderStream, 0x40, 5, field.Name)
+	}
+	e.encoderStream = appendStringLiteral(e.encoderStream, field.Value)
+	e.table.insertIntoDynamicTable(field)
+}
+
+// EncodeFieldSection encodes a header list sent on streamID. Fields are
+// added to the dynamic table when they fit without evicting entries that
+// unacknowledged sections still refer to, and referred to while the peer's
+// blocked streams limit allows it.
+func (e *QPACKEncoder) EncodeFieldSection(streamID uint64, hl HeaderList) ([]byte, error) {
+	base := e.table.nextID
+	var ric uint64
+	minReference := uint64(math.MaxUint64)
+	blocking := false
+
+	usable := func(id uint64) bool {
+		if e.table.absoluteEntry(id) == nil {
+			return false
+		}
+		return id < e.knownReceivedCount || e.canBlock(streamID, blocking)
+	}
+	reference := func(id uint64) {
+		if id+1 > ric {
+			ric = id + 1
+		}
+		if id < minReference {
+			minReference = id
+		}
+		if id >= e.knownReceivedCount {
+			blocking = true
+		}
+	}
+
+	var body []byte
+	for _, h := range hl {
+		sensitive := isSensitiveHeader(h, e.SensitiveHeaders)
+
+		if i, ok := qpackStaticByNameValue[h]; ok && !sensitive {
+			// Indexed Field Line, static
+			d := EncodeInteger(i, 6)
+			d[0] |= 0xc0
+			body = append(body, d...)
+			continue
+		}
+
+		if !sensitive {
+			id, ok := e.table.byNameValue[h]
+			if !ok && h.Size() <= e.table.MaxSize && e.canEvict(e.table.size+h.Size()-e.table.MaxSize, minReference) {
+				e.insert(h)
+				id, ok = e.table.nextID-1, true
+			}
+			if ok && usable(id) {
+				reference(id)
+				if id < base {
+					// Indexed Field Line, dynamic
+					d := EncodeInteger(int(base-1-id), 6)
+					d[0] |= 0x80
+					body = append(body, d...)
+				} else {
+					// Indexed Field Line with Post-Base Index
+					d := EncodeInteger(int(id-base), 4)
+					d[0] |= 0x10
+					body = append(body, d...)
+				}
+				continue
+			}
+		}
+
+		var n byte
+		if sensitive {
+			n = 0x20
+		}
+		if i, ok := qpackStaticByName[h.Name]; ok {
+			// Literal Field Line with Name Reference, static
+			d := EncodeInteger(i, 4)
+			d[0] |= 0x50 | n
+			body = append(body, d...)
+		} else if id, ok := e.table.byName[h.Name]; ok && usable(id) {
+			reference(id)
+			if id < base {
+				// Literal Field Line with Name Reference, dynamic
+				d := EncodeInteger(int(base-1-id), 4)
+				d[0] |= 0x40 | n
+				body = append(body, d...)
+			} else {
+				// Literal Field Line with Post-Base Name Reference
+				d := EncodeInteger(int(id-base), 3)
+				d[0] |= n >> 2
+				body = append(body, d...)
+			}
+		} else {
+			// Literal Field Line with Literal Name
+			body = appendPrefixedStringLiteral(body, 0x20|n>>1, 3, h.Name)
+		}
+		body = appendStringLiteral(body, h.Value)
+	}
+
+	result := EncodeInteger(encodeRequiredInsertCount(ric, e.maxTableCapacity), 8)
+	if ric > base {
+		d := EncodeInteger(int(ric-base-1), 7)
+		d[0] |= 0x80
+		result = append(result, d...)
+	} else if ric > 0 {
+		result = append(result, EncodeInteger(int(base-ric), 7)...)
+	} else {
+		result = append(result, 0)
+	}
+
+	if ric > 0 {
+		e.sections[streamID] = append(e.sections[streamID], qpackSection{ric, minReference})
+	}
+	return append(result, body...), nil
+}
+
+// WriteDecoderStream processes instructions received on the peer's decoder
+// stream. An instruction split across writes is carried over.
+func (e *QPACKEncoder) WriteDecoderStream(p []byte) (int, error) {
+	e.pending = append(e.pending, p...)
+
+	input := e.pending
+	for len(input) > 0 {
+		b := input[0]
+		var n int
+		var err error
+		switch {
+		case b&0x80 == 0x80:
+			// Section Acknowledgment
+			var streamID int
+			streamID, n, err = DecodeInteger(input, 7)
+			if err != nil {
+				break
+			}
+			sections := e.sections[uint64(streamID)]
+			if len(sections) == 0 {
+				err = errQPACKUnknownStream
+				break
+			}
+			if sections[0].requiredInsertCount > e.knownReceivedCount {
+				e.knownReceivedCount = sections[0].requiredInsertCount
+			}
+			if len(sections) == 1 {
+				delete(e.sections, uint64(streamID))
+			} else {
+				e.sections[uint64(streamID)] = sections[1:]
+			}
+		case b&0xc0 == 0x40:
+			// Stream Cancellation
+			var streamID int
+			streamID, n, err = DecodeInteger(input, 6)
+			if err != nil {
+				break
+			}
+			delete(e.sections, uint64(streamID))
+		default:
+			// Insert Count Increment
+			var increment int
+			increment, n, err = DecodeInteger(input, 6)
+			if err != nil {
+				break
+			}
+			if increment == 0 || e.knownReceivedCount+uint64(increment) > e.table.nextID {
+				err = errQPACKInsertCount
+				break
+			}
+			e.knownReceivedCount += uint64(increment)
+		}
+
+		if err == errTruncated {
+			break
+		} else if err != nil {
+			return 0, QPACKError{QPACKDecoderStreamError, err}
+		}
+		input = input[n:]
+	}
+
+	e.pending = append(e.pending[:0], input...)
+	return len(p), nil
+}
+
+type qpackBlockedSection struct {
+	streamID            uint64
+	requiredInsertCount uint64
+	section             []byte
+}
+
+// QPACKDecoder decompresses field sections. The peer's encoder stream is
+// fed with WriteEncoderStream, and the instructions for the peer's encoder
+// are collected with DecoderStream.
+type QPACKDecoder struct {
+	table HeaderTable
+
+	// maxTableCapacity and maxBlockedStreams are the values we advertise
+	// in SETTINGS_QPACK_MAX_TABLE_CAPACITY and
+	// SETTINGS_QPACK_BLOCKED_STREAMS.
+	maxTableCapacity  int
+	maxBlockedStreams int
+
+	// MaxStringLength caps every decoded name and value. 0 means no limit.
+	MaxStringLength int
+
+	acknowledged  uint64
+	blocked       []qpackBlockedSection
+	unblocked     func(streamID uint64, fields []HeaderField, err error)
+	decoderStream []byte
+	pending       []byte
+}
+
+func NewQPACKDecoder(maxTableCapacity, maxBlockedStreams int) *QPACKDecoder {
+	return &QPACKDecoder{
+		table:             newHeaderTable(0),
+		maxTableCapacity:  maxTableCapacity,
+		maxBlockedStreams: maxBlockedStreams,
+	}
+}
+
+// SetUnblockedFunc sets the function called when a field section blocked
+// by DecodeFieldSection has been decoded.
+func (d *QPACKDecoder) SetUnblockedFunc(unblocked func(streamID uint64, fields []HeaderField, err error)) {
+	d.unblocked = unblocked
+}
+
+// Entries returns a copy of the dynamic table, newest entry first.
+func (d *QPACKDecoder) Entries() []HeaderField {
+	return d.table.Entries()
+}
+
+// InsertCount returns the number of entries inserted so far.
+func (d *QPACKDecoder) InsertCount() uint64 {
+	return d.table.nextID
+}
+
+// DecoderStream returns the decoder instructions queued since the last
+// call, including an Insert Count Increment for entries received but not
+// yet acknowledged.
+func (d *QPACKDecoder) DecoderStream() []byte {
+	if d.table.nextID > d.acknowledged {
+		d.decoderStream = append(d.decoderStream, EncodeInteger(int(d.table.nextID-d.acknowledged), 6)...)
+		d.acknowledged = d.table.nextID
+	}
+	result := d.decoderStream
+	d.decoderStream = nil
+	return result
+}
+
+// CancelStream discards a blocked field section of a reset stream and
+// queues a Stream Cancellation instruction.
+func (d *QPACKDecoder) CancelStream(streamID uint64) {
+	for i, b := range d.blocked {
+		if b.streamID == streamID {
+			d.blocked = append(d.blocked[:i], d.blocked[i+1:]...)
+			break
+		}
+	}
+	if d.maxTableCapacity > 0 {
+		s := EncodeInteger(int(streamID), 6)
+		s[0] |= 0x40
+		d.decoderStream = append(d.decoderStream, s...)
+	}
+}
+
+func (d *QPACKDecoder) insert(field HeaderField) error {
+	if field.Size() > d.table.MaxSize {
+		return errQPACKEntryTooLarge
+	}
+	d.table.insertIntoDynamicTable(field)
+	return nil
+}
+
+// parseEncoderInstruction parses and applies the instruction at the start
+// of input. It returns errTruncated if input ends before the instruction.
+func (d *QPACKDecoder) parseEncoderInstruction(input []byte) (int, error) {
+	b := input[0]
+	switch {
+	case b&0x80 == 0x80:
+		// Insert with Name Reference
+		index, i, err := DecodeInteger(input, 6)
+		if err != nil {
+			return 0, err
+		}
+		var name *HeaderField
+		if b&0x40 == 0x40 {
+			if index < len(QPACKStaticTable) {
+				name = &QPACKStaticTable[index]
+			}
+		} else if uint64(index) < d.table.nextID {
+			name = d.table.absoluteEntry(d.table.nextID - 1 - uint64(index))
+		}
+		if name == nil {
+			return 0, errInvalidIndex
+		}
+		value, _, j, err := parsePrefixedStringLiteral(input[i:], 7, d.MaxStringLength)
+		if err != nil {
+			return 0, err
+		}
+		return i + j, d.insert(HeaderField{name.Name, value})
+	case b&0xc0 == 0x40:
+		// Insert with Literal Name
+		name, _, i, err := parsePrefixedStringLiteral(input, 5, d.MaxStringLength)
+		if err != nil {
+			return 0, err
+		}
+		value, _, j, err := parsePrefixedStringLiteral(input[i:], 7, d.MaxStringLength)
+		if err != nil {
+			return 0, err
+		}
+		return i + j, d.insert(HeaderField{name, value})
+	case b&0xe0 == 0x20:
+		// Set Dynamic Table Capacity
+		capacity, i, err := DecodeInteger(input, 5)
+		if err != nil {
+			return 0, err
+		}
+		if capacity > d.maxTableCapacity {
+			return 0, errQPACKTableCapacity
+		}
+		d.table.MaxSize = capacity
+		d.table.evictEntry()
+		return i, nil
+	default:
+		// Duplicate
+		index, i, err := DecodeInteger(input, 5)
+		if err != nil {
+			return 0, err
+		}
+		if uint64(index) >= d.table.nextID {
+			return 0, errInvalidIndex
+		}
+		field := d.table.absoluteEntry(d.table.nextID - 1 - uint64(index))
+		if field == nil {
+			return 0, errInvalidIndex
+		}
+		return i, d.insert(*field)
+	}
+}
+
+// WriteEncoderStream processes instructions received on the peer's encoder
+// stream. An instruction split across writes is carried over. Blocked
+// field sections that become decodable are passed to the unblocked
+// function.
+func (d *QPACKDecoder) WriteEncoderStream(p []byte) (int, error) {
+	d.pending = append(d.pending, p...)
+
+	input := d.pending
+	for len(input) > 0 {
+		n, err := d.parseEncoderInstruction(input)
+		if err == errTruncated {
+			break
+		} else if err != nil {
+			return 0, QPACKError{QPACKEncoderStreamError, err}
+		}
+		input = input[n:]
+	}
+	d.pending = append(d.pending[:0], input...)
+
+	blocked := d.blocked[:0]
+	var ready []qpackBlockedSection
+	for _, b := range d.blocked {
+		if b.requiredInsertCount <= d.table.nextID {
+			ready = append(ready, b)
+		} else {
+			blocked = append(blocked, b)
+		}
+	}
+	d.blocked = blocked
+
+	for _, b := range ready {
+		fields, err := d.DecodeFieldSection(b.streamID, b.section)
+		if d.unblocked != nil {
+			d.unblocked(b.streamID, fields, err)
+		}
+	}
+	return len(p), nil
+}
+
+// DecodeFieldSection decodes a complete field section received on
+// streamID. If the section refers to entries that have not been received
+// yet, it is kept, ErrQPACKBlocked is returned, and the fields are passed to
+// the unblocked function later.
+func (d *QPACKDecoder) DecodeFieldSection(streamID uint64, section []byte) ([]HeaderField, error) {
+	fields, err := d.decodeFieldSection(streamID, section)
+	if err != nil && err != ErrQPACKBlocked {
+		return nil, QPACKError{QPACKDecompressionFailed, err}
+	}
+	return fields, err
+}
+
+func (d *QPACKDecoder) decodeFieldSection(streamID uint64, section []byte) ([]HeaderField, error) {
+	encoded, i, err := DecodeInteger(section, 8)
+	if err != nil {
+		return nil, err
+	}
+	ric, err := decodeRequiredInsertCount(encoded, d.maxTableCapacity, d.table.nextID)
+	if err != nil {
+		return nil, err
+	}
+	if len(section) <= i {
+		return nil, errTruncated
+	}
+	sign := section[i]&0x80 == 0x80
+	delta, j, err := DecodeInteger(section[i:], 7)
+	if err != nil {
+		return nil, err
+	}
+	i += j
+
+	base := ric + uint64(delta)
+	if sign {
+		if uint64(delta) >= ric {
+			return nil, errQPACKRequiredInsertCount
+		}
+		base = ric - uint64(delta) - 1
+	}
+
+	if ric > d.table.nextID {
+		if len(d.blocked) >= d.maxBlockedStreams {
+			return nil, errQPACKBlockedStreams
+		}
+		d.blocked = append(d.blocked, qpackBlockedSection{streamID, ric, append([]byte{}, section...)})
+		return nil, ErrQPACKBlocked
+	}
+
+	dynamic := func(id uint64) (*HeaderField, error) {
+		if id >= ric {
+			return nil, errInvalidIndex
+		}
+		field := d.table.absoluteEntry(id)
+		if field == nil {
+			return nil, errInvalidIndex
+		}
+		return field, nil
+	}
+	static := func(index int) (*HeaderField, error) {
+		if index >= len(QPACKStaticTable) {
+			return nil, errInvalidIndex
+		}
+		return &QPACKStaticTable[index], nil
+	}
+
+	var result []HeaderField
+	for i < len(section) {
+		b := section[i]
+		var field *HeaderField
+		var name string
+		var index, n int
+		switch {
+		case b&0x80 == 0x80:
+			// Indexed Field Line
+			if index, n, err = DecodeInteger(section[i:], 6); err != nil {
+				return nil, err
+			}
+			if b&0x40 == 0x40 {
+				field, err = static(index)
+			} else if uint64(index) < base {
+				field, err = dynamic(base - 1 - uint64(index))
+			} else {
+				err = errInvalidIndex
+			}
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, *field)
+			i += n
+			continue
+		case b&0xf0 == 0x10:
+			// Indexed Field Line with Post-Base Index
+			if index, n, err = DecodeInteger(section[i:], 4); err != nil {
+				return nil, err
+			}
+			if field, err = dynamic(base + uint64(index)); err != nil {
+				return nil, err
+			}
+			result = append(result, *field)
+			i += n
+			continue
+		case b&0xc0 == 0x40:
+			// Literal Field Line with Name Reference
+			if index, n, err = DecodeInteger(section[i:], 4); err != nil {
+				return nil, err
+			}
+			if b&0x10 == 0x10 {
+				field, err = static(index)
+			} else if uint64(index) < base {
+				field, err = dynamic(base - 1 - uint64(index))
+			} else {
+				err = errInvalidIndex
+			}
+			if err != nil {
+				return nil, err
+			}
+			name = field.Name
+		case b&0xe0 == 0x20:
+			// Literal Field Line with Literal Name
+			if name, _, n, err = parsePrefixedStringLiteral(section[i:], 3, d.MaxStringLength); err != nil {
+				return nil, err
+			}
+		default:
+			// Literal Field Line with Post-Base Name Reference
+			if index, n, err = DecodeInteger(section[i:], 3); err != nil {
+				return nil, err
+			}
+			if field, err = dynamic(base + uint64(index)); err != nil {
+				return nil, err
+			}
+			name = field.Name
+		}
+		i += n
+
+		var value string
+		if value, _, n, err = parsePrefixedStringLiteral(section[i:], 7, d.MaxStringLength); err != nil {
+			return nil, err
+		}
+		result = append(result, HeaderField{name, value})
+		i += n
+	}
+
+	if ric > 0 {
+		s := EncodeInteger(int(streamID), 7)
+		s[0] |= 0x80
+		d.decoderStream = append(d.decoderStream, s...)
+		if ric > d.acknowledged {
+			d.acknowledged = ric
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeHexString(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	assert.Nil(t, err)
+	return b
+}
+
+func TestQPACKStaticTable(t *testing.T) {
+	assert.Equal(t, 99, len(QPACKStaticTable))
+	assert.Equal(t, HeaderField{":authority", ""}, QPACKStaticTable[0])
+	assert.Equal(t, HeaderField{":method", "GET"}, QPACKStaticTable[17])
+	assert.Equal(t, HeaderField{"x-frame-options", "sameorigin"}, QPACKStaticTable[98])
+}
+
+func TestQPACKDecoderExamples(t *testing.T) {
+	// RFC 9204 Appendix B
+	d := NewQPACKDecoder(220, 100)
+
+	// B.1 Literal Field Line with Name Reference
+	fields, err := d.DecodeFieldSection(0, decodeHexString(t, "0000 510b 2f69 6e64 6578 2e68 746d 6c"))
+	assert.Nil(t, err)
+	assert.Equal(t, []HeaderField{{":path", "/index.html"}}, fields)
+	assert.Empty(t, d.DecoderStream())
+
+	// B.2 Dynamic Table
+	_, err = d.WriteEncoderStream(decodeHexString(t, "3fbd01 c00f 7777 772e 6578 616d 706c 652e 636f 6d c10c 2f73 616d 706c 652f 7061 7468"))
+	assert.Nil(t, err)
+	fields, err = d.DecodeFieldSection(4, decodeHexString(t, "0381 10 11"))
+	assert.Nil(t, err)
+	assert.Equal(t, []HeaderField{{":authority", "www.example.com"}, {":path", "/sample/path"}}, fields)
+	assert.Equal(t, []byte{0x84}, d.DecoderStream())
+	assert.Equal(t, 106, d.table.getDynamicTableSize())
+
+	// B.3 Speculative Insert
+	_, err = d.WriteEncoderStream(decodeHexString(t, "4a63 7573 746f 6d2d 6b65 790c 6375 7374 6f6d 2d76 616c 7565"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x01}, d.DecoderStream())
+	assert.Equal(t, 160, d.table.getDynamicTableSize())
+
+	// B.4 Duplicate Instruction, Stream Cancellation
+	_, err = d.WriteEncoderStream([]byte{0x02})
+	assert.Nil(t, err)
+	fields, err = d.DecodeFieldSection(8, decodeHexString(t, "0500 80 c1 81"))
+	assert.Nil(t, err)
+	assert.Equal(t, []HeaderField{{":authority", "www.example.com"}, {":path", "/"}, {"custom-key", "custom-value"}}, fields)
+	d.CancelStream(8)
+	assert.Equal(t, []byte{0x88, 0x48}, d.DecoderStream())
+	assert.Equal(t, 217, d.table.getDynamicTableSize())
+
+	// B.5 Dynamic Table Insert, Eviction
+	_, err = d.WriteEncoderStream(decodeHexString(t, "810d 6375 7374 6f6d 2d76 616c 7565 32"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x01}, d.DecoderStream())
+	assert.Equal(t, []HeaderField{
+		{"custom-key", "custom-value2"},
+		{":authority", "www.example.com"},
+		{"custom-key", "custom-value"},
+		{":path", "/sample/path"},
+	}, d.Entries())
+	assert.Equal(t, 215, d.table.getDynamicTableSize())
+}
+
+func TestQPACKDecoderInvalid(t *testing.T) {
+	testcases := []struct {
+		encoderStream string
+		section       string
+	}{
+		// Indexed Field Line, static index out of range
+		{"", "0000 ff24"},
+		// Required Insert Count beyond the full range
+		{"", "0f00"},
+		// Dynamic reference at or beyond the Required Insert Count
+		{"3fbd01 c00f 7777 772e 6578 616d 706c 652e 636f 6d", "0200 10"},
+		// Negative Base
+		{"3fbd01 c00f 7777 772e 6578 616d 706c 652e 636f 6d", "0281 80"},
+	}
+
+	for i := 0; i < len(testcases); i++ {
+		tc := testcases[i]
+		d := NewQPACKDecoder(220, 100)
+		_, err := d.WriteEncoderStream(decodeHexString(t, tc.encoderStream))
+		assert.Nil(t, err)
+		_, err = d.DecodeFieldSection(0, decodeHexString(t, tc.section))
+		qe, ok := err.(QPACKError)
+		assert.True(t, ok, "%d: %v", i, err)
+		assert.Equal(t, QPACKDecompressionFailed, qe.Code, "%d", i)
+	}
+
+	// Set Dynamic Table Capacity above the advertised maximum
+	d := NewQPACKDecoder(100, 0)
+	_, err := d.WriteEncoderStream(decodeHexString(t, "3fbd01"))
+	assert.Equal(t, QPACKError{QPACKEncoderStreamError, errQPACKTableCapacity}, err)
+}
+
+func TestQPACKRequiredInsertCount(t *testing.T) {
+	for _, capacity := range []int{32, 220, 4096} {
+		maxEntries := qpackMaxEntries(capacity)
+		for total := uint64(0); total < 5*maxEntries; total++ {
+			// The Required Insert Count of any section the decoder can
+			// receive lies within MaxEntries of its insert count.
+			min := uint64(1)
+			if total > maxEntries {
+				min = total - maxEntries + 1
+			}
+			for ric := min; ric <= total+maxEntries; ric++ {
+				actual, err := decodeRequiredInsertCount(encodeRequiredInsertCount(ric, capacity), capacity, total)
+				assert.Nil(t, err)
+				assert.Equal(t, ric, actual)
+			}
+		}
+	}
+}
+
+func TestQPACKEncoder(t *testing.T) {
+	e := NewQPACKEncoder(220, 100)
+	d := NewQPACKDecoder(220, 100)
+
+	assert.Nil(t, e.SetCapacity(220))
+	instructions := e.EncoderStream()
+	assert.Equal(t, decodeHexString(t, "3fbd01"), instructions)
+	assert.Equal(t, errQPACKTableCapacity, e.SetCapacity(221))
+	_, err := d.WriteEncoderStream(instructions)
+	assert.Nil(t, err)
+
+	lists := []HeaderList{
+		{{":method", "GET"}, {":authority", "www.example.com"}, {":path", "/sample/path"}},
+		{{":method", "GET"}, {":authority", "www.example.com"}, {":path", "/sample/path"}, {"custom-key", "custom-value"}},
+		{{":method", "GET"}, {":authority", "www.example.com"}, {"authorization", "secret"}},
+	}
+	var section []byte
+	for i, hl := range lists {
+		streamID := uint64(4 * i)
+		section, err = e.EncodeFieldSection(streamID, hl)
+		assert.Nil(t, err)
+
+		_, err = d.WriteEncoderStream(e.EncoderStream())
+		assert.Nil(t, err)
+		fields, err := d.DecodeFieldSection(streamID, section)
+		assert.Nil(t, err)
+		assert.Equal(t, []HeaderField(hl), fields)
+
+		_, err = e.WriteDecoderStream(d.DecoderStream())
+		assert.Nil(t, err)
+		assert.Equal(t, e.Entries(), d.Entries())
+	}
+
+	// Everything has been acknowledged, and the credentials were never
+	// inserted.
+	assert.Equal(t, d.InsertCount(), e.knownReceivedCount)
+	assert.Empty(t, e.sections)
+	assert.Equal(t, 3, len(e.Entries()))
+
+	// A repeated section only refers to acknowledged entries.
+	section, err = e.EncodeFieldSection(12, lists[1])
+	assert.Nil(t, err)
+	assert.Equal(t, decodeHexString(t, "0400 d1 82 81 80"), section)
+	assert.Empty(t, e.EncoderStream())
+}
+
+func TestQPACKBlockedStreams(t *testing.T) {
+	hl := HeaderList{{"custom-key", "custom-value"}}
+
+	// Without blocked streams the encoder inserts speculatively but does
+	// not refer to unacknowledged entries.
+	e := NewQPACKEncoder(220, 0)
+	assert.Nil(t, e.SetCapacity(220))
+	section, err := e.EncodeFieldSection(0, hl)
+	assert.Nil(t, err)
+	d := NewQPACKDecoder(220, 0)
+	fields, err := d.DecodeFieldSection(0, section)
+	assert.Nil(t, err)
+	assert.Equal(t, []HeaderField(hl), fields)
+
+	// A section that arrives before the entries it refers to is blocked
+	// until the encoder stream catches up.
+	e = NewQPACKEncoder(220, 1)
+	assert.Nil(t, e.SetCapacity(220))
+	section, err = e.EncodeFieldSection(4, hl)
+	assert.Nil(t, err)
+
+	d = NewQPACKDecoder(220, 1)
+	var unblocked []HeaderField
+	d.SetUnblockedFunc(func(streamID uint64, fields []HeaderField, err error) {
+		assert.Equal(t, uint64(4), streamID)
+		assert.Nil(t, err)
+		unblocked = fields
+	})
+	_, err = d.DecodeFieldSection(4, section)
+	assert.Equal(t, ErrQPACKBlocked, err)
+
+	// A second blocked stream exceeds the limit.
+	_, err = d.DecodeFieldSection(8, section)
+	assert.Equal(t, QPACKError{QPACKDecompressionFailed, errQPACKBlockedStreams}, err)
+
+	// The encoder stream may arrive in pieces.
+	for _, b := range e.EncoderStream() {
+		assert.Nil(t, unblocked)
+		_, err = d.WriteEncoderStream([]byte{b})
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []HeaderField(hl), unblocked)
+	assert.Equal(t, []byte{0x84}, d.DecoderStream())
+
+	// The encoder has used up its blocked streams, so another stream
+	// falls back to literals.
+	section, err = e.EncodeFieldSection(8, HeaderList{{"custom-key", "custom-value"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x00, 0x00}, section[:2])
+}
+
+func TestQPACKEncoderEviction(t *testing.T) {
+	e := NewQPACKEncoder(100, 100)
+	assert.Nil(t, e.SetCapacity(100))
+
+	a := HeaderField{"custom-key", "value-a-that-is-long"}
+	b := HeaderField{"custom-key", "value-b-that-is-long"}
+
+	_, err := e.EncodeFieldSection(0, HeaderList{a})
+	assert.Nil(t, err)
+	assert.Equal(t, []HeaderField{a}, e.Entries())
+
+	// a is still referenced by an unacknowledged section and must not be
+	// evicted to make room for b.
+	_, err = e.EncodeFieldSection(4, HeaderList{b})
+	assert.Nil(t, err)
+	assert.Equal(t, []HeaderField{a}, e.Entries())
+	assert.Equal(t, errQPACKEntriesInUse, e.SetCapacity(0))
+
+	// The section on stream 4 refers to the name of a.
+	_, err = e.WriteDecoderStream([]byte{0x80, 0x84})
+	assert.Nil(t, err)
+	_, err = e.EncodeFieldSection(8, HeaderList{b})
+	assert.Nil(t, err)
+	assert.Equal(t, []HeaderField{b}, e.Entries())
+
+	// Acknowledging a stream without outstanding sections is an error.
+	_, err = e.WriteDecoderStream([]byte{0x80})
+	assert.Equal(t, QPACKError{QPACKDecoderStreamError, errQPACKUnknownStream}, err)
+}
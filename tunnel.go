@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errTunnelClosed = errors.New("use of closed tunnel")
+
+// TunnelError reports a CONNECT request that the peer answered with a
+// status other than 2xx.
+type TunnelError struct {
+	Status   int
+	Response *Response
+}
+
+func (e *TunnelError) Error() string {
+	return fmt.Sprintf("tunnel refused with status %d", e.Status)
+}
+
+type tunnelAddr struct {
+	network string
+	address string
+}
+
+func (a tunnelAddr) Network() string {
+	return a.network
+}
+
+func (a tunnelAddr) String() string {
+	return a.address
+}
+
+// Tunnel is a CONNECT stream used as a net.Conn. DATA frames carry the
+// tunnelled bytes, END_STREAM closes one direction like a TCP FIN, and
+// RST_STREAM(CONNECT_ERROR) stands for a TCP reset.
+type Tunnel struct {
+	// Response is the peer's 2xx response to the CONNECT request.
+	Response *Response
+
+	conn   *Connection
+	stream *Stream
+	local  net.Addr
+	remote net.Addr
+
+	// wmu keeps the DATA frames of one Write together, and END_STREAM
+	// after all of them.
+	wmu sync.Mutex
+
+	// mu must not be held while acquiring Connection.mu.
+	mu            sync.Mutex
+	cond          *sync.Cond
+	buf           bytes.Buffer
+	recvWindow    int
+	unacked       int
+	readErr       error
+	err           error
+	closed        bool
+	writeClosed   bool
+	remoteClosed  bool
+	released      bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+// Connect opens a tunnel to authority, a host and port, with the CONNECT
+// method (RFC 9113 8.5). Any number of tunnels can share the connection.
+func (c *Connection) Connect(authority string, headers []HeaderField) (*Tunnel, error) {
+	if _, _, err := net.SplitHostPort(authority); err != nil {
+		return nil, err
+	}
+	hs := []HeaderField{
+		{":method", "CONNECT"},
+		{":authority", authority},
+	}
+	return c.connect(append(hs, headers...), tunnelAddr{"tcp", authority})
+}
+
+// ExtendedConnect opens a tunnel that speaks protocol to u, which must be a
+// URL of this connection's origin, with the extended CONNECT method of
+// RFC 8441. The peer has to allow it with SETTINGS_ENABLE_CONNECT_PROTOCOL.
+func (c *Connection) ExtendedConnect(protocol string, u *url.URL, headers []HeaderField) (*Tunnel, error) {
+	if err := c.checkOrigin(u); err != nil {
+		return nil, err
+	}
+	if err := c.waitPeerSettings(); err != nil {
+		return nil, err
+	}
+	if !c.EnableConnectProtocol {
+		return nil, errors.New("peer does not support extended CONNECT")
+	}
+
+	hs := []HeaderField{
+		{":method", "CONNECT"},
+		{":protocol", protocol},
+		{":scheme", c.scheme},
+		{":authority", strings.ToLower(u.Host)},
+		{":path", u.RequestURI()},
+	}
+	return c.connect(append(hs, headers...), tunnelAddr{protocol, u.Host})
+}
+
+// connect sends a CONNECT request and waits for the final response.
+func (c *Connection) connect(hl []HeaderField, remote net.Addr) (*Tunnel, error) {
+	hs, err := normalizeRequestHeaders(hl)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := c.openStream()
+	if err != nil {
+		return nil, err
+	}
+	sid := s.StreamID
+
+	if err := c.sendHeaderList(sid, false, hs); err != nil {
+		c.closeStream(sid)
+		return nil, err
+	}
+
+	for {
+		frame, ok := <-s.recv
+		if !ok {
+			return nil, c.streamError(s)
+		}
+
+		switch f := frame.(type) {
+		case *HeaderListFrame:
+			status, err := validateResponseHeaders(f.Fields, false)
+			if err == nil && 100 <= status && status < 200 && f.Header.Flags.Has(FlagsEndStream) {
+				err = HeaderFieldError{":status", "informational response ends the stream"}
+			}
+			if err != nil {
+				c.resetStream(sid, ErrorCodeProtocolError)
+				c.closeStream(sid)
+				return nil, StreamError{sid, ErrorCodeProtocolError}
+			}
+			if status < 200 {
+				continue
+			}
+
+			response := &Response{
+				Header: make(map[string][]string),
+				Fields: f.Fields,
+			}
+			for _, h := range f.Fields {
+				addHeaderValue(response.Header, h.Name, h.Value)
+			}
+			if status >= 300 {
+				if !f.Header.Flags.Has(FlagsEndStream) {
+					c.resetStream(sid, ErrorCodeCancel)
+				}
+				c.closeStream(sid)
+				return nil, &TunnelError{status, response}
+			}
+
+			t := &Tunnel{
+				Response:   response,
+				conn:       c,
+				stream:     s,
+				local:      tunnelAddr{"tcp", ""},
+				remote:     remote,
+				recvWindow: defaultWindowSize,
+			}
+			t.cond = sync.NewCond(&t.mu)
+			if conn := c.netConn(); conn != nil {
+				t.local = conn.LocalAddr()
+			}
+			if f.Header.Flags.Has(FlagsEndStream) {
+				t.remoteClosed = true
+				t.readErr = io.EOF
+			} else {
+				go t.receive()
+			}
+			return t, nil
+		case *RstStreamFrame:
+			c.closeStream(sid)
+			return nil, StreamError{sid, ErrorCode(f.Payload.ErrorCode)}
+		default:
+			c.resetStream(sid, ErrorCodeProtocolError)
+			c.closeStream(sid)
+			return nil, StreamError{sid, ErrorCodeProtocolError}
+		}
+	}
+}
+
+// receive moves the stream's DATA into the read buffer until the peer ends
+// or resets the stream.
+func (t *Tunnel) receive() {
+	sid := t.stream.StreamID
+	for {
+		frame, ok := <-t.stream.recv
+		if !ok {
+			t.abort(t.conn.streamError(t.stream), ErrorCodeNoError)
+			return
+		}
+
+		end := frame.GetHeader().Flags.Has(FlagsEndStream)
+		code := ErrorCodeNoError
+		switch f := frame.(type) {
+		case *DataFrame:
+			code = t.receiveData(f)
+		case *HeaderListFrame:
+			if _, err := validateResponseHeaders(f.Fields, true); err != nil || !end {
+				code = ErrorCodeProtocolError
+			}
+		case *RstStreamFrame:
+			t.abort(StreamError{sid, ErrorCode(f.Payload.ErrorCode)}, ErrorCodeNoError)
+			return
+		default:
+			continue
+		}
+
+		if code != ErrorCodeNoError {
+			t.abort(StreamError{sid, code}, code)
+			return
+		}
+		if end {
+			t.mu.Lock()
+			t.remoteClosed = true
+			t.readErr = io.EOF
+			t.cond.Broadcast()
+			t.mu.Unlock()
+			t.release()
+			return
+		}
+	}
+}
+
+func (t *Tunnel) receiveData(f *DataFrame) ErrorCode {
+	t.mu.Lock()
+	length := int(f.Header.Length)
+	if length > t.recvWindow {
+		t.mu.Unlock()
+		return ErrorCodeFlowControlError
+	}
+	t.recvWindow -= length
+
+	// Padding, and data that nobody is going to read, count as consumed
+	// straight away.
+	consumed := length - len(f.Payload.Data)
+	if t.closed {
+		consumed = length
+	} else {
+		t.buf.Write(f.Payload.Data)
+		t.cond.Broadcast()
+	}
+	increment := t.consume(consumed)
+	t.mu.Unlock()
+
+	if increment > 0 {
+		t.conn.sendWindowUpdate(t.stream.StreamID, uint32(increment))
+	}
+	return ErrorCodeNoError
+}
+
+// consume credits n octets taken from the receive window and returns the
+// WINDOW_UPDATE increment to send, if one is due. t.mu must be held.
+func (t *Tunnel) consume(n int) int {
+	t.unacked += n
+	if t.unacked < defaultWindowSize/2 || t.remoteClosed || t.err != nil {
+		return 0
+	}
+	increment := t.unacked
+	t.unacked = 0
+	t.recvWindow += increment
+	return increment
+}
+
+// abort ends both directions with err, resetting the stream with code
+// unless it is NO_ERROR.
+func (t *Tunnel) abort(err error, code ErrorCode) {
+	t.mu.Lock()
+	if t.err != nil || t.released {
+		t.mu.Unlock()
+		return
+	}
+	t.err = err
+	t.cond.Broadcast()
+	t.mu.Unlock()
+
+	if code != ErrorCodeNoError {
+		t.conn.resetStream(t.stream.StreamID, code)
+	}
+	t.release()
+}
+
+// release forgets the stream once both directions are closed or it has
+// been reset.
+func (t *Tunnel) release() {
+	t.mu.Lock()
+	done := !t.released && (t.err != nil || t.remoteClosed && t.writeClosed)
+	if done {
+		t.released = true
+	}
+	t.mu.Unlock()
+
+	if done {
+		t.conn.closeStream(t.stream.StreamID)
+	}
+}
+
+func (t *Tunnel) Read(b []byte) (int, error) {
+	t.mu.Lock()
+	for t.buf.Len() == 0 {
+		var err error
+		switch {
+		case t.closed:
+			err = errTunnelClosed
+		case t.err != nil:
+			err = t.err
+		case t.readErr != nil:
+			err = t.readErr
+		case deadlinePassed(t.readDeadline):
+			err = os.ErrDeadlineExceeded
+		}
+		if err != nil || len(b) == 0 {
+			t.mu.Unlock()
+			return 0, err
+		}
+		t.cond.Wait()
+	}
+
+	n, _ := t.buf.Read(b)
+	increment := t.consume(n)
+	t.mu.Unlock()
+
+	if increment > 0 {
+		t.conn.sendWindowUpdate(t.stream.StreamID, uint32(increment))
+	}
+	return n, nil
+}
+
+// Write sends b in DATA frames as the flow-control windows allow.
+func (t *Tunnel) Write(b []byte) (int, error) {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+
+	if err := t.writable(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for n < len(b) {
+		// Leave room for padding.
+		size := len(b) - n + 256
+		if max := t.conn.peerMaxFrameSize(); size > max {
+			size = max
+		}
+		window, err := t.conn.reserveSendWindow(t.stream, size, t.writable)
+		if err != nil {
+			return n, err
+		}
+
+		df, m := t.conn.newDataFrameWithin(t.stream.StreamID, 0, b[n:], window)
+		t.conn.releaseSendWindow(t.stream, window-int(df.Header.Length))
+		t.conn.sendFrame(df)
+		n += m
+	}
+	return n, nil
+}
+
+func (t *Tunnel) writable() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch {
+	case t.closed || t.writeClosed:
+		return errTunnelClosed
+	case t.err != nil:
+		return t.err
+	case deadlinePassed(t.writeDeadline):
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// CloseWrite ends the sending direction with END_STREAM, like shutting
+// down the write side of a TCP connection.
+func (t *Tunnel) CloseWrite() error {
+	t.mu.Lock()
+	if t.writeClosed || t.err != nil {
+		t.mu.Unlock()
+		return nil
+	}
+	t.writeClosed = true
+	t.mu.Unlock()
+
+	// Writers waiting for window give up now, so wmu is released soon.
+	t.conn.wakeSendWindowWaiters()
+	t.wmu.Lock()
+	df, _ := t.conn.newDataFrameWithin(t.stream.StreamID, FlagsEndStream, nil, 0)
+	t.conn.sendFrame(df)
+	t.wmu.Unlock()
+
+	t.release()
+	return nil
+}
+
+// Close ends the sending direction and stops reading. Data that the peer
+// sends until it ends the stream too is discarded.
+func (t *Tunnel) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	increment := t.consume(t.buf.Len())
+	t.buf.Reset()
+	t.cond.Broadcast()
+	t.mu.Unlock()
+
+	if increment > 0 {
+		t.conn.sendWindowUpdate(t.stream.StreamID, uint32(increment))
+	}
+	return t.CloseWrite()
+}
+
+// Reset aborts the tunnel with RST_STREAM(CONNECT_ERROR), which the proxy
+// passes on to the target as a TCP reset.
+func (t *Tunnel) Reset() error {
+	t.mu.Lock()
+	t.closed = true
+	t.cond.Broadcast()
+	t.mu.Unlock()
+
+	t.abort(StreamError{t.stream.StreamID, ErrorCodeConnectError}, ErrorCodeConnectError)
+	return nil
+}
+
+func (t *Tunnel) LocalAddr() net.Addr {
+	return t.local
+}
+
+func (t *Tunnel) RemoteAddr() net.Addr {
+	return t.remote
+}
+
+func (t *Tunnel) SetDeadline(deadline time.Time) error {
+	t.SetReadDeadline(deadline)
+	return t.SetWriteDeadline(deadline)
+}
+
+func (t *Tunnel) SetReadDeadline(deadline time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.readDeadline = deadline
+	t.readTimer = resetDeadlineTimer(t.readTimer, deadline, func() {
+		t.mu.Lock()
+		t.cond.Broadcast()
+		t.mu.Unlock()
+	})
+	t.cond.Broadcast()
+	return nil
+}
+
+func (t *Tunnel) SetWriteDeadline(deadline time.Time) error {
+	t.mu.Lock()
+	t.writeDeadline = deadline
+	t.writeTimer = resetDeadlineTimer(t.writeTimer, deadline, t.conn.wakeSendWindowWaiters)
+	t.mu.Unlock()
+
+	t.conn.wakeSendWindowWaiters()
+	return nil
+}
+
+// resetDeadlineTimer stops timer and returns one that calls wake at
+// deadline, or nil if there is no deadline.
+func resetDeadlineTimer(timer *time.Timer, deadline time.Time, wake func()) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if deadline.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(deadline), wake)
+}
+
+func deadlinePassed(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testWindowUpdateFrame(sid uint32, increment uint32) *WindowUpdateFrame {
+	return &WindowUpdateFrame{
+		FrameBase: FrameBase{
+			Header: FrameHeader{
+				Length:           4,
+				Type:             FrameTypeWindowUpdate,
+				StreamIdentifier: sid,
+			},
+		},
+		Payload: WindowUpdatePayload{
+			WindowSizeIncrement: increment,
+		},
+	}
+}
+
+func testRstStreamFrame(sid uint32, code ErrorCode) *RstStreamFrame {
+	return &RstStreamFrame{
+		FrameBase: FrameBase{
+			Header: FrameHeader{
+				Length:           4,
+				Type:             FrameTypeRstStream,
+				StreamIdentifier: sid,
+			},
+		},
+		Payload: RstStreamPayload{
+			ErrorCode: uint32(code),
+		},
+	}
+}
+
+type tunnelResult struct {
+	tunnel *Tunnel
+	err    error
+}
+
+// openTestTunnel opens a tunnel that the test server accepts with a 200
+// response, and returns the CONNECT request's header fields.
+func openTestTunnel(t *testing.T, c *Connection, srv *testServer, open func() (*Tunnel, error)) (*Tunnel, []HeaderField) {
+	result := make(chan tunnelResult, 1)
+	go func() {
+		tunnel, err := open()
+		result <- tunnelResult{tunnel, err}
+	}()
+
+	hf := srv.readFrame(FrameTypeHeaders).(*HeadersFrame)
+	assert.False(t, hf.Header.Flags.Has(FlagsEndStream))
+	fields, err := srv.decoder.Decode(hf.Payload.HeaderBlockFragment)
+	assert.Nil(t, err)
+	srv.writeFrame(testHeadersFrame(hf.Header.StreamIdentifier, FlagsEndHeaders, []byte{0x88}))
+
+	select {
+	case r := <-result:
+		if !assert.Nil(t, r.err) {
+			t.FailNow()
+		}
+		assert.Equal(t, hf.Header.StreamIdentifier, r.tunnel.stream.StreamID)
+		return r.tunnel, fields
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for tunnel")
+	}
+	return nil, nil
+}
+
+// readTestData reads DATA frames of stream sid until n octets have arrived.
+func (s *testServer) readTestData(sid uint32, n int) []byte {
+	var data []byte
+	for len(data) < n {
+		df := s.readFrame(FrameTypeData).(*DataFrame)
+		assert.Equal(s.t, sid, df.Header.StreamIdentifier)
+		assert.LessOrEqual(s.t, df.Header.Length, uint32(16384))
+		data = append(data, df.Payload.Data...)
+	}
+	return data
+}
+
+func TestConnect(t *testing.T) {
+	c, srv := newTestConnection(t, nil)
+	tunnel, fields := openTestTunnel(t, c, srv, func() (*Tunnel, error) {
+		return c.Connect("example.com:443", nil)
+	})
+	sid := tunnel.stream.StreamID
+	assert.Equal(t, []HeaderField{{":method", "CONNECT"}, {":authority", "example.com:443"}}, fields)
+	assert.Equal(t, []string{"200"}, tunnel.Response.Header[":status"])
+	assert.Equal(t, "example.com:443", tunnel.RemoteAddr().String())
+
+	n, err := tunnel.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	df := srv.readFrame(FrameTypeData).(*DataFrame)
+	assert.Equal(t, Flags(0), df.Header.Flags)
+	assert.Equal(t, []byte("hello"), df.Payload.Data)
+
+	srv.writeFrame(testDataFrame(sid, 0, []byte("world")))
+	srv.writeFrame(testDataFrame(sid, FlagsEndStream, []byte("!")))
+	data, err := ioutil.ReadAll(tunnel)
+	assert.Nil(t, err)
+	assert.Equal(t, "world!", string(data))
+
+	assert.Nil(t, tunnel.Close())
+	df = srv.readFrame(FrameTypeData).(*DataFrame)
+	assert.Equal(t, FlagsEndStream, df.Header.Flags)
+	assert.Empty(t, df.Payload.Data)
+
+	_, err = tunnel.Write([]byte("again"))
+	assert.Equal(t, errTunnelClosed, err)
+	c.mu.Lock()
+	assert.NotContains(t, c.Streams, sid)
+	c.mu.Unlock()
+}
+
+func TestConnectRefused(t *testing.T) {
+	c, srv := newTestConnection(t, nil)
+
+	_, err := c.Connect("example.com", nil)
+	assert.NotNil(t, err)
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := c.Connect("example.com:443", nil)
+		result <- err
+	}()
+	hf := srv.readFrame(FrameTypeHeaders).(*HeadersFrame)
+	srv.writeFrame(testHeadersFrame(hf.Header.StreamIdentifier, FlagsEndHeaders|FlagsEndStream, []byte{0x8d}))
+
+	select {
+	case err := <-result:
+		if assert.IsType(t, &TunnelError{}, err) {
+			assert.Equal(t, 404, err.(*TunnelError).Status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for response")
+	}
+}
+
+func TestTunnelSendFlowControl(t *testing.T) {
+	c, srv := newTestConnection(t, nil)
+	tunnel, _ := openTestTunnel(t, c, srv, func() (*Tunnel, error) {
+		return c.Connect("example.com:443", nil)
+	})
+	sid := tunnel.stream.StreamID
+
+	data := bytes.Repeat([]byte{'x'}, 70000)
+	written := make(chan error, 1)
+	go func() {
+		_, err := tunnel.Write(data)
+		written <- err
+	}()
+
+	received := srv.readTestData(sid, 65535)
+	assert.Equal(t, 65535, len(received))
+	select {
+	case <-written:
+		t.Fatal("wrote beyond the flow-control window")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Both the connection and the stream window have to grow.
+	srv.writeFrame(testWindowUpdateFrame(0, 10000))
+	srv.writeFrame(testWindowUpdateFrame(sid, 10000))
+	received = append(received, srv.readTestData(sid, 70000-65535)...)
+	assert.Equal(t, data, received)
+	select {
+	case err := <-written:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for write")
+	}
+
+	tunnel.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	n, err := tunnel.Write(data[:10000])
+	assert.Equal(t, os.ErrDeadlineExceeded, err)
+	assert.Equal(t, 10000-(70000-65535), n)
+}
+
+func TestTunnelInitialWindowSize(t *testing.T) {
+	c, srv := newTestConnection(t, nil)
+	srv.writeFrame(testSettingsFrame(0, SettingsParameter{SettingsInitialWindowSize, 100}))
+	for !srv.readFrame(FrameTypeSettings).GetHeader().Flags.Has(FlagsAck) {
+	}
+
+	tunnel, _ := openTestTunnel(t, c, srv, func() (*Tunnel, error) {
+		return c.Connect("example.com:443", nil)
+	})
+	sid := tunnel.stream.StreamID
+	go tunnel.Write(bytes.Repeat([]byte{'x'}, 1000))
+	assert.Equal(t, 100, len(srv.readTestData(sid, 100)))
+
+	// A larger initial window size grows open streams' windows by the
+	// difference.
+	srv.writeFrame(testSettingsFrame(0, SettingsParameter{SettingsInitialWindowSize, 300}))
+	assert.Equal(t, 200, len(srv.readTestData(sid, 200)))
+}
+
+func TestTunnelReceiveFlowControl(t *testing.T) {
+	c, srv := newTestConnection(t, nil)
+	tunnel, _ := openTestTunnel(t, c, srv, func() (*Tunnel, error) {
+		return c.Connect("example.com:443", nil)
+	})
+	sid := tunnel.stream.StreamID
+
+	chunk := bytes.Repeat([]byte{'x'}, 16384)
+	for i := 0; i < 3; i++ {
+		srv.writeFrame(testDataFrame(sid, 0, chunk))
+	}
+	buf := make([]byte, 3*len(chunk))
+	for n := 0; n < len(buf); {
+		m, err := tunnel.Read(buf[n:])
+		assert.Nil(t, err)
+		n += m
+	}
+
+	var increment uint32
+	for increment < defaultWindowSize/2 {
+		wf := srv.readFrame(FrameTypeWindowUpdate).(*WindowUpdateFrame)
+		if wf.Header.StreamIdentifier == sid {
+			increment += wf.Payload.WindowSizeIncrement
+		}
+	}
+	assert.LessOrEqual(t, increment, uint32(len(buf)))
+
+	// The peer overruns the window that is left.
+	for i := uint32(0); i <= defaultWindowSize/16384; i++ {
+		srv.writeFrame(testDataFrame(sid, 0, chunk))
+	}
+	rf := srv.readFrame(FrameTypeRstStream).(*RstStreamFrame)
+	assert.Equal(t, sid, rf.Header.StreamIdentifier)
+	assert.Equal(t, uint32(ErrorCodeFlowControlError), rf.Payload.ErrorCode)
+}
+
+func TestTunnelReset(t *testing.T) {
+	c, srv := newTestConnection(t, nil)
+	tunnel, _ := openTestTunnel(t, c, srv, func() (*Tunnel, error) {
+		return c.Connect("example.com:443", nil)
+	})
+	sid := tunnel.stream.StreamID
+
+	srv.writeFrame(testRstStreamFrame(sid, ErrorCodeConnectError))
+	_, err := tunnel.Read(make([]byte, 10))
+	assert.Equal(t, StreamError{sid, ErrorCodeConnectError}, err)
+	_, err = tunnel.Write([]byte("hello"))
+	assert.Equal(t, StreamError{sid, ErrorCodeConnectError}, err)
+
+	tunnel, _ = openTestTunnel(t, c, srv, func() (*Tunnel, error) {
+		return c.Connect("example.com:443", nil)
+	})
+	assert.Nil(t, tunnel.Reset())
+	rf := srv.readFrame(FrameTypeRstStream).(*RstStreamFrame)
+	assert.Equal(t, tunnel.stream.StreamID, rf.Header.StreamIdentifier)
+	assert.Equal(t, uint32(ErrorCodeConnectError), rf.Payload.ErrorCode)
+	_, err = tunnel.Read(make([]byte, 10))
+	assert.Equal(t, errTunnelClosed, err)
+}
+
+func TestTunnelReadDeadline(t *testing.T) {
+	c, srv := newTestConnection(t, nil)
+	tunnel, _ := openTestTunnel(t, c, srv, func() (*Tunnel, error) {
+		return c.Connect("example.com:443", nil)
+	})
+
+	tunnel.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := tunnel.Read(make([]byte, 10))
+	assert.Equal(t, os.ErrDeadlineExceeded, err)
+
+	tunnel.SetReadDeadline(time.Time{})
+	srv.writeFrame(testDataFrame(tunnel.stream.StreamID, 0, []byte("late")))
+	buf := make([]byte, 10)
+	n, err := tunnel.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "late", string(buf[:n]))
+}
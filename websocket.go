@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+type WebSocketOpcode byte
+
+const (
+	WebSocketContinuation WebSocketOpcode = 0x0
+	WebSocketText         WebSocketOpcode = 0x1
+	WebSocketBinary       WebSocketOpcode = 0x2
+	WebSocketClose        WebSocketOpcode = 0x8
+	WebSocketPing         WebSocketOpcode = 0x9
+	WebSocketPong         WebSocketOpcode = 0xa
+)
+
+func (op WebSocketOpcode) isControl() bool {
+	return op&0x8 != 0
+}
+
+// Close status codes (RFC 6455 7.4.1)
+const (
+	WebSocketCloseNormal          = 1000
+	WebSocketCloseGoingAway       = 1001
+	WebSocketCloseProtocolError   = 1002
+	WebSocketCloseUnsupportedData = 1003
+	WebSocketCloseNoStatus        = 1005
+	WebSocketCloseInvalidPayload  = 1007
+	WebSocketClosePolicyViolation = 1008
+	WebSocketCloseMessageTooBig   = 1009
+	WebSocketCloseInternalError   = 1011
+)
+
+// WebSocketCloseError is returned by ReadMessage once the closing handshake
+// has started. Code and Reason are the status the peer sent, or the one we
+// failed the connection with.
+type WebSocketCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *WebSocketCloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// defaultMaxWebSocketMessageSize is the initial WebSocket.MaxMessageSize.
+const defaultMaxWebSocketMessageSize = 16 << 20
+
+var errWebSocketClosed = errors.New("websocket closed")
+
+type webSocketFrame struct {
+	fin     bool
+	rsv     byte
+	opcode  WebSocketOpcode
+	masked  bool
+	payload []byte
+}
+
+// appendWebSocketFrame appends a frame to dst. The payload is masked with
+// mask if it is not nil.
+func appendWebSocketFrame(dst []byte, fin bool, opcode WebSocketOpcode, mask []byte, payload []byte) []byte {
+	b := byte(opcode)
+	if fin {
+		b |= 0x80
+	}
+	dst = append(dst, b)
+
+	var maskBit byte
+	if mask != nil {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		dst = append(dst, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		dst = append(dst, maskBit|126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		dst = append(dst, maskBit|127)
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(len(payload)))
+		dst = append(dst, length[:]...)
+	}
+
+	if mask == nil {
+		return append(dst, payload...)
+	}
+	dst = append(dst, mask[:4]...)
+	for i, c := range payload {
+		dst = append(dst, c^mask[i%4])
+	}
+	return dst
+}
+
+// readWebSocketFrame reads a frame and unmasks its payload. Data frame
+// payloads longer than maxLength, unless it is negative, are not read and
+// return errWebSocketMessageTooBig.
+func readWebSocketFrame(r *bufio.Reader, maxLength int) (webSocketFrame, error) {
+	var f webSocketFrame
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return f, err
+	}
+	f.fin = header[0]&0x80 != 0
+	f.rsv = header[0] & 0x70
+	f.opcode = WebSocketOpcode(header[0] & 0x0f)
+	f.masked = header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return f, unexpectedEOF(err)
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return f, unexpectedEOF(err)
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return f, webSocketProtocolError("invalid payload length")
+		}
+	}
+
+	if f.opcode.isControl() && (length > 125 || !f.fin) {
+		return f, webSocketProtocolError("invalid control frame")
+	}
+	if maxLength >= 0 && length > uint64(maxLength) && !f.opcode.isControl() {
+		return f, errWebSocketMessageTooBig
+	}
+
+	var mask [4]byte
+	if f.masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return f, unexpectedEOF(err)
+		}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return f, unexpectedEOF(err)
+	}
+	if f.masked {
+		for i := range f.payload {
+			f.payload[i] ^= mask[i%4]
+		}
+	}
+	return f, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// webSocketProtocolError is a violation of RFC 6455 by the peer.
+type webSocketProtocolError string
+
+func (e webSocketProtocolError) Error() string {
+	return "websocket: " + string(e)
+}
+
+var errWebSocketMessageTooBig = errors.New("websocket: message too big")
+
+// WebSocket is a WebSocket client connection (RFC 6455) running on an
+// extended CONNECT stream (RFC 8441), so that any number of them share one
+// HTTP/2 connection.
+type WebSocket struct {
+	// Protocol is the subprotocol the server selected, if any.
+	Protocol string
+
+	// MaxMessageSize limits the size of received messages. 0 means no
+	// limit.
+	MaxMessageSize int
+
+	tunnel *Tunnel
+	reader *bufio.Reader
+
+	// closeErr is only used by the reader.
+	closeErr *WebSocketCloseError
+
+	mu        sync.Mutex
+	closeSent bool
+}
+
+// DialWebSocket opens a WebSocket to rawurl, a ws or wss URL of this
+// connection's origin, offering the given subprotocols.
+func (c *Connection) DialWebSocket(rawurl string, protocols []string, headers []HeaderField) (*WebSocket, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("url %q is not a websocket url", u.Redacted())
+	}
+	u.Fragment = ""
+
+	hs := []HeaderField{{"sec-websocket-version", "13"}}
+	if len(protocols) > 0 {
+		hs = append(hs, HeaderField{"sec-websocket-protocol", strings.Join(protocols, ", ")})
+	}
+	tunnel, err := c.ExtendedConnect("websocket", u, append(hs, headers...))
+	if err != nil {
+		return nil, err
+	}
+
+	ws := &WebSocket{
+		MaxMessageSize: defaultMaxWebSocketMessageSize,
+		tunnel:         tunnel,
+		reader:         bufio.NewReader(tunnel),
+	}
+	header := tunnel.Response.Header
+	if len(header["sec-websocket-protocol"]) > 0 {
+		ws.Protocol = header["sec-websocket-protocol"][0]
+		if len(header["sec-websocket-protocol"]) > 1 || !containsString(protocols, ws.Protocol) {
+			tunnel.Reset()
+			return nil, fmt.Errorf("websocket: server selected unknown subprotocol %q", ws.Protocol)
+		}
+	}
+	if len(header["sec-websocket-extensions"]) > 0 {
+		tunnel.Reset()
+		return nil, errors.New("websocket: server selected an extension that was not offered")
+	}
+	return ws, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadMessage returns the next text or binary message. Pings are answered
+// while waiting. Once the peer closes the WebSocket, or has to be failed
+// for violating the protocol, ReadMessage returns a *WebSocketCloseError.
+func (ws *WebSocket) ReadMessage() (WebSocketOpcode, []byte, error) {
+	var opcode WebSocketOpcode
+	var message []byte
+	for {
+		limit := -1
+		if ws.MaxMessageSize > 0 {
+			limit = ws.MaxMessageSize - len(message)
+		}
+		f, err := readWebSocketFrame(ws.reader, limit)
+		switch e := err.(type) {
+		case nil:
+		case webSocketProtocolError:
+			return 0, nil, ws.fail(WebSocketCloseProtocolError, string(e))
+		default:
+			if err == errWebSocketMessageTooBig {
+				return 0, nil, ws.fail(WebSocketCloseMessageTooBig, "message too big")
+			}
+			if ws.closeErr != nil {
+				return 0, nil, ws.closeErr
+			}
+			return 0, nil, err
+		}
+
+		if f.rsv != 0 {
+			return 0, nil, ws.fail(WebSocketCloseProtocolError, "reserved bits set")
+		}
+		if f.masked {
+			return 0, nil, ws.fail(WebSocketCloseProtocolError, "masked frame from server")
+		}
+
+		switch f.opcode {
+		case WebSocketPing:
+			if err := ws.writeFrame(WebSocketPong, f.payload); err != nil && err != errWebSocketClosed {
+				return 0, nil, err
+			}
+			continue
+		case WebSocketPong:
+			continue
+		case WebSocketClose:
+			return 0, nil, ws.receiveClose(f.payload)
+		case WebSocketContinuation:
+			if message == nil {
+				return 0, nil, ws.fail(WebSocketCloseProtocolError, "unexpected continuation frame")
+			}
+		case WebSocketText, WebSocketBinary:
+			if message != nil {
+				return 0, nil, ws.fail(WebSocketCloseProtocolError, "unfinished fragmented message")
+			}
+			opcode = f.opcode
+			message = []byte{}
+		default:
+			return 0, nil, ws.fail(WebSocketCloseProtocolError, "reserved opcode")
+		}
+
+		message = append(message, f.payload...)
+		if f.fin {
+			if opcode == WebSocketText && !utf8.Valid(message) {
+				return 0, nil, ws.fail(WebSocketCloseInvalidPayload, "invalid UTF-8 in text message")
+			}
+			return opcode, message, nil
+		}
+	}
+}
+
+// receiveClose answers a Close frame from the peer and ends the stream.
+func (ws *WebSocket) receiveClose(payload []byte) error {
+	code := WebSocketCloseNoStatus
+	reason := ""
+	switch {
+	case len(payload) == 1:
+		return ws.fail(WebSocketCloseProtocolError, "invalid close frame")
+	case len(payload) >= 2:
+		code = int(binary.BigEndian.Uint16(payload))
+		reason = string(payload[2:])
+		if !validCloseCode(code) {
+			return ws.fail(WebSocketCloseProtocolError, "invalid close code")
+		}
+		if !utf8.ValidString(reason) {
+			return ws.fail(WebSocketCloseInvalidPayload, "invalid UTF-8 in close reason")
+		}
+	}
+
+	// The peer's status is echoed back.
+	echo := payload
+	if len(echo) >= 2 {
+		echo = echo[:2]
+	}
+	ws.closeErr = &WebSocketCloseError{code, reason}
+	ws.writeFrame(WebSocketClose, echo)
+	ws.tunnel.Close()
+	return ws.closeErr
+}
+
+// validCloseCode reports whether code may be sent in a Close frame.
+func validCloseCode(code int) bool {
+	switch {
+	case 1000 <= code && code <= 1003, 1007 <= code && code <= 1011:
+		return true
+	case 3000 <= code && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// fail closes the WebSocket after a protocol violation by the peer.
+func (ws *WebSocket) fail(code int, reason string) error {
+	if ws.closeErr == nil {
+		ws.closeErr = &WebSocketCloseError{code, reason}
+	}
+	ws.CloseWithStatus(code, reason)
+	ws.tunnel.Close()
+	return ws.closeErr
+}
+
+// WriteMessage sends data as a single text or binary message.
+func (ws *WebSocket) WriteMessage(opcode WebSocketOpcode, data []byte) error {
+	switch opcode {
+	case WebSocketText:
+		if !utf8.Valid(data) {
+			return errors.New("websocket: invalid UTF-8 in text message")
+		}
+	case WebSocketBinary:
+	default:
+		return fmt.Errorf("websocket: invalid message opcode %d", opcode)
+	}
+	return ws.writeFrame(opcode, data)
+}
+
+// Ping sends a Ping frame. The peer's Pong is consumed by ReadMessage.
+func (ws *WebSocket) Ping(data []byte) error {
+	if len(data) > 125 {
+		return errors.New("websocket: ping payload too long")
+	}
+	return ws.writeFrame(WebSocketPing, data)
+}
+
+// CloseWithStatus starts the closing handshake and ends the sending
+// direction of the stream. ReadMessage returns the remaining messages and
+// then the peer's Close status.
+func (ws *WebSocket) CloseWithStatus(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > 125 {
+		return errors.New("websocket: close reason too long")
+	}
+
+	if err := ws.writeFrame(WebSocketClose, payload); err != nil {
+		if err == errWebSocketClosed {
+			return nil
+		}
+		return err
+	}
+	return ws.tunnel.CloseWrite()
+}
+
+// Close starts the closing handshake with status 1000.
+func (ws *WebSocket) Close() error {
+	return ws.CloseWithStatus(WebSocketCloseNormal, "")
+}
+
+// writeFrame masks and sends a single frame. Nothing is sent after a Close
+// frame.
+func (ws *WebSocket) writeFrame(opcode WebSocketOpcode, payload []byte) error {
+	mask := make([]byte, 4)
+	if _, err := rand.Read(mask); err != nil {
+		return err
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.closeSent {
+		return errWebSocketClosed
+	}
+	if opcode == WebSocketClose {
+		ws.closeSent = true
+	}
+	_, err := ws.tunnel.Write(appendWebSocketFrame(nil, true, opcode, mask, payload))
+	return err
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// RFC 6455 5.7
+func TestWebSocketFrameExamples(t *testing.T) {
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	testcases := []struct {
+		fin     bool
+		opcode  WebSocketOpcode
+		mask    []byte
+		payload []byte
+		wire    string
+	}{
+		{true, WebSocketText, nil, []byte("Hello"), "810548656c6c6f"},
+		{true, WebSocketText, mask, []byte("Hello"), "818537fa213d7f9f4d5158"},
+		{false, WebSocketText, nil, []byte("Hel"), "010348656c"},
+		{true, WebSocketContinuation, nil, []byte("lo"), "80026c6f"},
+		{true, WebSocketPing, nil, []byte("Hello"), "890548656c6c6f"},
+		{true, WebSocketPong, mask, []byte("Hello"), "8a8537fa213d7f9f4d5158"},
+		{true, WebSocketBinary, nil, bytes.Repeat([]byte{0xaa}, 256), "827e0100" + strings.Repeat("aa", 256)},
+		{true, WebSocketBinary, nil, bytes.Repeat([]byte{0xaa}, 65536), "827f0000000000010000" + strings.Repeat("aa", 65536)},
+	}
+
+	for i, tc := range testcases {
+		actual := appendWebSocketFrame(nil, tc.fin, tc.opcode, tc.mask, tc.payload)
+		assert.Equal(t, tc.wire, hex.EncodeToString(actual), "%d", i)
+
+		f, err := readWebSocketFrame(bufio.NewReader(bytes.NewReader(actual)), -1)
+		assert.Nil(t, err, "%d", i)
+		assert.Equal(t, webSocketFrame{tc.fin, 0, tc.opcode, tc.mask != nil, tc.payload}, f, "%d", i)
+	}
+}
+
+func TestReadWebSocketFrameErrors(t *testing.T) {
+	testcases := []struct {
+		wire     string
+		limit    int
+		expected error
+	}{
+		{"0900", -1, webSocketProtocolError("invalid control frame")},
+		{"897e0080", -1, webSocketProtocolError("invalid control frame")},
+		{"827f8000000000000000", -1, webSocketProtocolError("invalid payload length")},
+		{"8206", 5, errWebSocketMessageTooBig},
+		{"820648656c", -1, io.ErrUnexpectedEOF},
+	}
+
+	for i, tc := range testcases {
+		wire, _ := hex.DecodeString(tc.wire)
+		_, err := readWebSocketFrame(bufio.NewReader(bytes.NewReader(wire)), tc.limit)
+		assert.Equal(t, tc.expected, err, "%d", i)
+	}
+}
+
+func TestExtendedConnectDisabled(t *testing.T) {
+	c, srv := newTestConnection(t, nil)
+	srv.writeFrame(testSettingsFrame(0))
+
+	_, err := c.DialWebSocket("ws://example.com/chat", nil, nil)
+	assert.NotNil(t, err)
+	assert.False(t, c.EnableConnectProtocol)
+}
+
+// testWebSocketServer is the server end of a WebSocket on a test stream.
+type testWebSocketServer struct {
+	srv    *testServer
+	sid    uint32
+	reader *bufio.Reader
+	writer *bytes.Buffer
+}
+
+func (s *testWebSocketServer) writeFrame(fin bool, opcode WebSocketOpcode, payload []byte) {
+	s.srv.writeFrame(testDataFrame(s.sid, 0, appendWebSocketFrame(nil, fin, opcode, nil, payload)))
+}
+
+// readFrame reads the next WebSocket frame that the client sent, which
+// has to be masked.
+func (s *testWebSocketServer) readFrame() webSocketFrame {
+	for s.reader.Buffered() == 0 && s.writer.Len() == 0 {
+		df := s.srv.readFrame(FrameTypeData).(*DataFrame)
+		assert.Equal(s.srv.t, s.sid, df.Header.StreamIdentifier)
+		s.writer.Write(df.Payload.Data)
+	}
+	f, err := readWebSocketFrame(s.reader, -1)
+	assert.Nil(s.srv.t, err)
+	assert.True(s.srv.t, f.masked)
+	return f
+}
+
+func openTestWebSocket(t *testing.T, protocols []string, response HeaderList) (*WebSocket, []HeaderField, *testWebSocketServer) {
+	c, srv := newTestConnection(t, nil)
+	srv.writeFrame(testSettingsFrame(0, SettingsParameter{SettingsEnableConnectProtocol, 1}))
+
+	result := make(chan *WebSocket, 1)
+	go func() {
+		ws, _ := c.DialWebSocket("ws://example.com/chat?room=1", protocols, nil)
+		result <- ws
+	}()
+
+	hf := srv.readFrame(FrameTypeHeaders).(*HeadersFrame)
+	fields, err := srv.decoder.Decode(hf.Payload.HeaderBlockFragment)
+	assert.Nil(t, err)
+	block, err := EncodeHeaders(append(HeaderList{{":status", "200"}}, response...))
+	assert.Nil(t, err)
+	srv.writeFrame(testHeadersFrame(hf.Header.StreamIdentifier, FlagsEndHeaders, block))
+
+	var ws *WebSocket
+	select {
+	case ws = <-result:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for websocket")
+	}
+	var buf bytes.Buffer
+	return ws, fields, &testWebSocketServer{srv, hf.Header.StreamIdentifier, bufio.NewReader(&buf), &buf}
+}
+
+func TestDialWebSocket(t *testing.T) {
+	ws, fields, server := openTestWebSocket(t, []string{"chat", "superchat"}, HeaderList{{"sec-websocket-protocol", "chat"}})
+	if !assert.NotNil(t, ws) {
+		return
+	}
+	assert.Equal(t, []HeaderField{
+		{":method", "CONNECT"},
+		{":protocol", "websocket"},
+		{":scheme", "http"},
+		{":authority", "example.com"},
+		{":path", "/chat?room=1"},
+		{"sec-websocket-version", "13"},
+		{"sec-websocket-protocol", "chat, superchat"},
+	}, fields)
+	assert.Equal(t, "chat", ws.Protocol)
+
+	assert.Nil(t, ws.WriteMessage(WebSocketText, []byte("Hello")))
+	f := server.readFrame()
+	assert.Equal(t, WebSocketText, f.opcode)
+	assert.Equal(t, []byte("Hello"), f.payload)
+
+	// A ping between the fragments of a message is answered.
+	server.writeFrame(false, WebSocketBinary, []byte{1, 2})
+	server.writeFrame(true, WebSocketPing, []byte("ping"))
+	server.writeFrame(true, WebSocketContinuation, []byte{3})
+	opcode, message, err := ws.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, WebSocketBinary, opcode)
+	assert.Equal(t, []byte{1, 2, 3}, message)
+	f = server.readFrame()
+	assert.Equal(t, WebSocketPong, f.opcode)
+	assert.Equal(t, []byte("ping"), f.payload)
+
+	server.writeFrame(true, WebSocketClose, append([]byte{0x03, 0xe8}, "bye"...))
+	_, _, err = ws.ReadMessage()
+	assert.Equal(t, &WebSocketCloseError{WebSocketCloseNormal, "bye"}, err)
+	f = server.readFrame()
+	assert.Equal(t, WebSocketClose, f.opcode)
+	assert.Equal(t, []byte{0x03, 0xe8}, f.payload)
+	df := server.srv.readFrame(FrameTypeData).(*DataFrame)
+	assert.True(t, df.Header.Flags.Has(FlagsEndStream))
+
+	assert.Equal(t, errWebSocketClosed, ws.WriteMessage(WebSocketText, []byte("again")))
+}
+
+func TestWebSocketProtocolViolation(t *testing.T) {
+	testcases := []struct {
+		frame []byte
+		code  int
+	}{
+		{appendWebSocketFrame(nil, true, WebSocketText, []byte{1, 2, 3, 4}, []byte("masked")), WebSocketCloseProtocolError},
+		{appendWebSocketFrame(nil, true, WebSocketContinuation, nil, []byte("x")), WebSocketCloseProtocolError},
+		{appendWebSocketFrame(nil, true, 0x3, nil, nil), WebSocketCloseProtocolError},
+		{appendWebSocketFrame(nil, true, WebSocketText, nil, []byte{0xff}), WebSocketCloseInvalidPayload},
+		{appendWebSocketFrame(nil, true, WebSocketClose, nil, []byte{0x03, 0xed}), WebSocketCloseProtocolError},
+		{[]byte{0xc1, 0x00}, WebSocketCloseProtocolError},
+	}
+
+	for i, tc := range testcases {
+		ws, _, server := openTestWebSocket(t, nil, nil)
+		if !assert.NotNil(t, ws) {
+			return
+		}
+		server.srv.writeFrame(testDataFrame(server.sid, 0, tc.frame))
+		_, _, err := ws.ReadMessage()
+		if assert.IsType(t, &WebSocketCloseError{}, err, "%d", i) {
+			assert.Equal(t, tc.code, err.(*WebSocketCloseError).Code, "%d", i)
+		}
+
+		f := server.readFrame()
+		assert.Equal(t, WebSocketClose, f.opcode, "%d", i)
+		assert.Equal(t, []byte{byte(tc.code >> 8), byte(tc.code)}, f.payload[:2], "%d", i)
+	}
+}
+
+func TestWebSocketMessageTooBig(t *testing.T) {
+	ws, _, server := openTestWebSocket(t, nil, nil)
+	if !assert.NotNil(t, ws) {
+		return
+	}
+	ws.MaxMessageSize = 4
+
+	server.writeFrame(false, WebSocketText, []byte("abc"))
+	server.writeFrame(true, WebSocketContinuation, []byte("de"))
+	_, _, err := ws.ReadMessage()
+	assert.Equal(t, &WebSocketCloseError{WebSocketCloseMessageTooBig, "message too big"}, err)
+}
+
+func TestWebSocketUnofferedProtocol(t *testing.T) {
+	ws, _, server := openTestWebSocket(t, []string{"chat"}, HeaderList{{"sec-websocket-protocol", "other"}})
+	assert.Nil(t, ws)
+	rf := server.srv.readFrame(FrameTypeRstStream).(*RstStreamFrame)
+	assert.Equal(t, uint32(ErrorCodeConnectError), rf.Payload.ErrorCode)
+}